@@ -0,0 +1,115 @@
+package ydb
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/boylee1111/ydb/ydbserverrpc"
+)
+
+const defaultBlockCacheSize = 64 * 1024 * 1024 // Default block cache budget in bytes
+
+// blockCache keeps recently read segment blocks and records in memory. It is
+// shared by every open table of a server and evicts the least recently used
+// entries once the budget is exceeded.
+type blockCache struct {
+	locker   *sync.Mutex
+	capacity int64                                      // Budget in bytes, 0 disables the cache
+	size     int64                                      // Bytes currently cached
+	lru      *list.List                                 // Front is the most recently used
+	files    map[string]map[blockCacheKey]*list.Element // File path -> entries of the file
+	hits     uint64
+	misses   uint64
+}
+
+// blockCacheKey locates cached bytes in a file. The length is part of the key
+// because a block and its first record start at the same offset.
+type blockCacheKey struct {
+	offset int64
+	length int64
+}
+
+type blockCacheEntry struct {
+	path string
+	key  blockCacheKey
+	data []byte
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		locker:   new(sync.Mutex),
+		capacity: capacity,
+		lru:      list.New(),
+		files:    make(map[string]map[blockCacheKey]*list.Element),
+	}
+}
+
+func (cache *blockCache) get(path string, key blockCacheKey) ([]byte, bool) {
+	cache.locker.Lock()
+	defer cache.locker.Unlock()
+
+	if elem, ok := cache.files[path][key]; ok {
+		cache.hits++
+		cache.lru.MoveToFront(elem)
+		return elem.Value.(*blockCacheEntry).data, true
+	}
+	cache.misses++
+	return nil, false
+}
+
+func (cache *blockCache) put(path string, key blockCacheKey, data []byte) {
+	cache.locker.Lock()
+	defer cache.locker.Unlock()
+
+	if int64(len(data)) > cache.capacity {
+		return
+	}
+	if _, ok := cache.files[path][key]; ok {
+		return
+	}
+	if _, ok := cache.files[path]; !ok {
+		cache.files[path] = make(map[blockCacheKey]*list.Element)
+	}
+	cache.files[path][key] = cache.lru.PushFront(&blockCacheEntry{
+		path: path,
+		key:  key,
+		data: data,
+	})
+	cache.size += int64(len(data))
+
+	for cache.size > cache.capacity {
+		cache.remove(cache.lru.Back())
+	}
+}
+
+// invalidate drops every entry of a file, called when the file is deleted.
+func (cache *blockCache) invalidate(path string) {
+	cache.locker.Lock()
+	defer cache.locker.Unlock()
+
+	for _, elem := range cache.files[path] {
+		cache.remove(elem)
+	}
+}
+
+func (cache *blockCache) remove(elem *list.Element) {
+	entry := cache.lru.Remove(elem).(*blockCacheEntry)
+	cache.size -= int64(len(entry.data))
+	delete(cache.files[entry.path], entry.key)
+	if len(cache.files[entry.path]) == 0 {
+		delete(cache.files, entry.path)
+	}
+}
+
+func (cache *blockCache) stats() ydbserverrpc.CacheStats {
+	cache.locker.Lock()
+	defer cache.locker.Unlock()
+
+	return ydbserverrpc.CacheStats{
+		Capacity: cache.capacity,
+		Size:     cache.size,
+		Entries:  cache.lru.Len(),
+		Hits:     cache.hits,
+		Misses:   cache.misses,
+	}
+}
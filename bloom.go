@@ -0,0 +1,82 @@
+package ydb
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+)
+
+const defaultBloomFalsePositive = 0.01 // Default false positive rate of segment filters
+
+// bloomFilter answers whether a segment may hold a row key. It uses double
+// hashing, the i-th probe is h1 + i*h2.
+type bloomFilter struct {
+	bits   []byte
+	probes uint32
+}
+
+func newBloomFilter(keys int, falsePositive float64) *bloomFilter {
+	if keys < 1 {
+		keys = 1
+	}
+	m := math.Ceil(-float64(keys) * math.Log(falsePositive) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(keys) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return &bloomFilter{
+		bits:   make([]byte, (int(m)+7)/8),
+		probes: uint32(k),
+	}
+}
+
+func bloomHash(key string) uint64 {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(key))
+	return hasher.Sum64()
+}
+
+func (f *bloomFilter) addHash(h uint64) {
+	nbits := uint64(len(f.bits)) * 8
+	h1, h2 := h, h>>33|h<<31
+	for i := uint32(0); i < f.probes; i++ {
+		pos := (h1 + uint64(i)*h2) % nbits
+		f.bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	if f == nil {
+		return true
+	}
+	nbits := uint64(len(f.bits)) * 8
+	h := bloomHash(key)
+	h1, h2 := h, h>>33|h<<31
+	for i := uint32(0); i < f.probes; i++ {
+		pos := (h1 + uint64(i)*h2) % nbits
+		if f.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) encode() []byte {
+	buf := make([]byte, 4+len(f.bits))
+	binary.BigEndian.PutUint32(buf, f.probes)
+	copy(buf[4:], f.bits)
+	return buf
+}
+
+func decodeBloomFilter(buf []byte) (*bloomFilter, error) {
+	if len(buf) < 5 {
+		return nil, errCorruptSegment
+	}
+	return &bloomFilter{
+		bits:   buf[4:],
+		probes: binary.BigEndian.Uint32(buf),
+	}, nil
+}
@@ -0,0 +1,414 @@
+package ydb
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boylee1111/ydb/ydbserverrpc"
+	"go.etcd.io/bbolt"
+)
+
+// Segments are compacted size-tiered: a run of neighbouring segments of
+// similar size is merged into one once it is long enough. Only neighbours are
+// merged so the output can take their place in the age order.
+const (
+	compactionMinSegments = 4   // Shortest run worth merging, by default
+	compactionMaxSegments = 32  // Longest run merged at once
+	compactionBucketLow   = 0.5 // Smallest size ratio to the run average
+	compactionBucketHigh  = 1.5 // Largest size ratio to the run average
+)
+
+var errCompactionAborted = errors.New("Compaction aborted.")
+
+// compactor runs the compactions of one table in a background goroutine.
+type compactor struct {
+	locker   *sync.Mutex
+	wake     chan struct{} // Signals new segments or a manual request
+	stop     chan struct{}
+	done     *sync.WaitGroup
+	full     bool // A manual full compaction is pending
+	progress ydbserverrpc.CompactionProgress
+}
+
+func newCompactor() *compactor {
+	return &compactor{
+		locker: new(sync.Mutex),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   new(sync.WaitGroup),
+	}
+}
+
+// startCompaction starts a new compaction loop. Needs the table config lock.
+func (table *ydbTable) startCompaction(ydb *ydbServer) {
+	c := newCompactor()
+	c.done.Add(1)
+	table.dataLocker.Lock()
+	table.compactor = c
+	table.dataLocker.Unlock()
+	go table.compactionLoop(ydb, c)
+	c.notify()
+}
+
+// stopCompaction aborts a running compaction and waits for the loop to exit.
+// Needs the table config lock.
+func (table *ydbTable) stopCompaction() {
+	table.dataLocker.Lock()
+	c := table.compactor
+	table.compactor = nil
+	table.dataLocker.Unlock()
+	if c == nil {
+		return
+	}
+	close(c.stop)
+	c.done.Wait()
+}
+
+// requestCompaction asks for the segments of every family to be merged into
+// one. Needs the table config lock.
+func (table *ydbTable) requestCompaction() {
+	c := table.compactor
+	if c == nil {
+		return
+	}
+	c.locker.Lock()
+	c.full = true
+	c.locker.Unlock()
+	c.notify()
+}
+
+// compactionProgress needs the table config lock.
+func (table *ydbTable) compactionProgress() ydbserverrpc.CompactionProgress {
+	c := table.compactor
+	if c == nil {
+		return ydbserverrpc.CompactionProgress{}
+	}
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.progress
+}
+
+func (c *compactor) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *compactor) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (table *ydbTable) compactionLoop(ydb *ydbServer, c *compactor) {
+	defer c.done.Done()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.wake:
+		}
+
+		// Keep compacting while there is work, each run may make the next
+		// tier long enough.
+		for !c.stopped() {
+			// A full compaction lasts until every family is down to one run
+			c.locker.Lock()
+			full := c.full
+			c.locker.Unlock()
+
+			inputs := table.pickCompaction(full)
+			if len(inputs) == 0 {
+				c.locker.Lock()
+				c.full = false
+				c.locker.Unlock()
+				break
+			}
+			err := table.compact(ydb, c, inputs, full)
+
+			c.locker.Lock()
+			if err != nil {
+				c.full = false
+			}
+			c.progress.Running = false
+			c.progress.Segments = len(table.snapshotSegments())
+			if err != nil {
+				c.progress.LastError = err.Error()
+			} else {
+				c.progress.LastError = ""
+				c.progress.Completed++
+			}
+			c.progress.LastFinished = time.Now()
+			c.locker.Unlock()
+			if err != nil {
+				break
+			}
+		}
+	}
+}
+
+func (table *ydbTable) snapshotSegments() []*segment {
+	table.dataLocker.RLock()
+	defer table.dataLocker.RUnlock()
+	segments := make([]*segment, len(table.segments))
+	copy(segments, table.segments)
+	return segments
+}
+
+// pickCompaction returns the neighbouring segments of one family to merge
+// next, or nil. A full compaction merges the first run of two or more, other
+// compactions follow the strategy of the table.
+func (table *ydbTable) pickCompaction(full bool) []*segment {
+	table.dataLocker.RLock()
+	strategy := table.metadata.Compaction
+	minSegments := table.metadata.CompactionMinSegments
+	table.dataLocker.RUnlock()
+	if minSegments == 0 {
+		minSegments = compactionMinSegments
+	}
+
+	runs := familyRuns(table.snapshotSegments())
+	if full {
+		for _, run := range runs {
+			if len(run) >= 2 {
+				return run
+			}
+		}
+		return nil
+	}
+	if strategy == ydbserverrpc.CompactionManual {
+		return nil
+	}
+
+	var best []*segment
+	for _, segments := range runs {
+		for i := range segments {
+			var total int64
+			j := i
+			for ; j < len(segments) && j-i < compactionMaxSegments; j++ {
+				size := float64(segments[j].meta.Size)
+				if j > i {
+					average := float64(total) / float64(j-i)
+					if size < average*compactionBucketLow || size > average*compactionBucketHigh {
+						break
+					}
+				}
+				total += segments[j].meta.Size
+			}
+			if j-i >= minSegments && j-i > len(best) {
+				best = segments[i:j]
+			}
+		}
+	}
+	return best
+}
+
+// familyRuns splits segments, oldest first, into runs of segments of one
+// family. Segments of other families hold other columns and do not end a
+// run, but segments holding every family end all runs around them.
+func familyRuns(segments []*segment) [][]*segment {
+	runs := make([][]*segment, 0)
+	open := make(map[string]int) // Family -> its run in runs
+	for _, seg := range segments {
+		family := seg.meta.Family
+		if _, ok := open[""]; family == "" && !ok {
+			open = make(map[string]int)
+		} else if family != "" {
+			delete(open, "")
+		}
+		if i, ok := open[family]; ok {
+			runs[i] = append(runs[i], seg)
+			continue
+		}
+		open[family] = len(runs)
+		runs = append(runs, []*segment{seg})
+	}
+	return runs
+}
+
+// oldest reports whether no segment older than seg holds columns of its
+// family. Needs the table lock.
+func (table *ydbTable) oldest(seg *segment) bool {
+	for _, older := range table.segments {
+		if older == seg {
+			return true
+		}
+		if seg.meta.Family == "" || older.meta.Family == "" || older.meta.Family == seg.meta.Family {
+			return false
+		}
+	}
+	return true
+}
+
+// compact merges inputs, neighbours in the age order of their family, into a
+// single segment of that family that keeps the newest versions of every column, as many as
+// its family allows, and drops expired cells. When the
+// oldest segment takes part, deleted data is dropped for good. The row index
+// is rewritten to the new record offsets and the input files are deleted.
+func (table *ydbTable) compact(ydb *ydbServer, c *compactor, inputs []*segment, manual bool) error {
+	inputRows := 0
+	children := make([]rowIterator, 0, len(inputs))
+	for _, seg := range inputs {
+		inputRows += seg.meta.Rows
+		children = append(children, seg.iterator())
+	}
+	segmentCount := len(table.snapshotSegments())
+	c.locker.Lock()
+	c.progress.Running = true
+	c.progress.Manual = manual
+	c.progress.InputSegments = len(inputs)
+	c.progress.InputRows = inputRows
+	c.progress.RowsWritten = 0
+	c.progress.Segments = segmentCount
+	c.locker.Unlock()
+
+	// Tombstones only matter while older segments of the family exist
+	table.dataLocker.Lock()
+	id := table.nextSegmentID
+	table.nextSegmentID++
+	bottom := table.oldest(inputs[0])
+	options := table.snapshotOptions()
+	table.dataLocker.Unlock()
+
+	path := tableSegmentName(table.metadata.TableName, id)
+	w, err := newSegmentWriter(path, segmentMeta{
+		ID:     id,
+		Seq:    inputs[len(inputs)-1].meta.Seq,
+		Family: inputs[0].meta.Family,
+	}, options.falsePositive(), options.familyCompression(inputs[0].meta.Family))
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0)
+	locs := make([]rowLocation, 0)
+	dropped := make([]string, 0)
+	now := time.Now().UnixNano()
+	it := newMergeIterator(children)
+	for it.seek(""); it.valid(); it.next() {
+		if c.stopped() {
+			w.abort()
+			return errCompactionAborted
+		}
+		col, err := it.row()
+		if err != nil {
+			w.abort()
+			return err
+		}
+		col.trimVersions(options.familyMaxVersions)
+		col.dropExpired(now, options.familyTTL)
+		if bottom {
+			col.dropTombstones()
+		}
+		if col.empty() {
+			dropped = append(dropped, it.key())
+			continue
+		}
+		loc, err := w.add(it.key(), col.encode())
+		if err != nil {
+			w.abort()
+			return err
+		}
+		keys = append(keys, it.key())
+		locs = append(locs, loc)
+
+		c.locker.Lock()
+		c.progress.RowsWritten++
+		c.locker.Unlock()
+	}
+	if err := it.err(); err != nil {
+		w.abort()
+		return err
+	}
+	meta, err := w.finish()
+	if err != nil {
+		w.abort()
+		return err
+	}
+	output, err := openSegment(path, meta, ydb.blockCache)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	// Swap the segments while no reader is looking at them
+	table.dataLocker.Lock()
+	defer table.dataLocker.Unlock()
+
+	replaced := make(map[uint64]bool)
+	for _, seg := range inputs {
+		replaced[seg.meta.ID] = true
+	}
+	err = ydb.indexDB.Update(func(tx *bbolt.Tx) error {
+		segments, rowIndex, err := createTableBuckets(tx, table.metadata.TableName)
+		if err != nil {
+			return err
+		}
+		for id := range replaced {
+			if err := segments.Delete(segmentKey(id)); err != nil {
+				return err
+			}
+		}
+		v, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err := segments.Put(segmentKey(meta.ID), v); err != nil {
+			return err
+		}
+		if err := unindexRows(rowIndex, dropped, replaced); err != nil {
+			return err
+		}
+		return indexRows(rowIndex, keys, locs, replaced)
+	})
+	if err != nil {
+		output.close()
+		os.Remove(path)
+		return err
+	}
+
+	segments := make([]*segment, 0, len(table.segments)-len(inputs)+1)
+	for _, seg := range table.segments {
+		if !replaced[seg.meta.ID] {
+			segments = append(segments, seg)
+		} else if seg == inputs[0] {
+			segments = append(segments, output)
+		}
+	}
+	table.segments = segments
+	for _, seg := range inputs {
+		seg.retire()
+	}
+	return nil
+}
+
+// removeOrphanSegments deletes segment files of the table that are not in the
+// manifest, left behind by a crash during flush or compaction.
+func (table *ydbTable) removeOrphanSegments() {
+	live := make(map[uint64]bool)
+	for _, seg := range table.segments {
+		live[seg.meta.ID] = true
+	}
+	prefix := "./" + table.metadata.TableName + "."
+	matches, _ := filepath.Glob(filepath.Join(".", "*.sst"))
+	for _, match := range matches {
+		name := "./" + match
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".sst"), 10, 64)
+		if err != nil || live[id] {
+			continue
+		}
+		os.Remove(name)
+	}
+}
@@ -0,0 +1,84 @@
+package ydb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+
+	"github.com/boylee1111/ydb/ydbserverrpc"
+)
+
+// Data blocks are stored as a codec byte followed by the block, compressed by
+// that codec. The codec byte is the ydbserverrpc.Compression value, so every
+// block can be read whatever the family options are today.
+
+var errUnknownCodec = errors.New("Unknown block codec.")
+
+func validCompression(c ydbserverrpc.Compression) bool {
+	return c >= ydbserverrpc.CompressionNone && c <= ydbserverrpc.CompressionZlib
+}
+
+// compressBlock encodes a data block for disk. Blocks that do not shrink are
+// stored as they are.
+func compressBlock(c ydbserverrpc.Compression, block []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(c))
+	var w io.WriteCloser
+	switch c {
+	case ydbserverrpc.CompressionNone:
+		buf.Write(block)
+		return buf.Bytes(), nil
+	case ydbserverrpc.CompressionFlate:
+		w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+	case ydbserverrpc.CompressionGzip:
+		w = gzip.NewWriter(buf)
+	case ydbserverrpc.CompressionZlib:
+		w = zlib.NewWriter(buf)
+	default:
+		return nil, errUnknownCodec
+	}
+	if _, err := w.Write(block); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() > len(block) {
+		return compressBlock(ydbserverrpc.CompressionNone, block)
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressBlock decodes a data block written by compressBlock.
+func decompressBlock(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errCorruptSegment
+	}
+	payload := bytes.NewReader(data[1:])
+	var r io.ReadCloser
+	var err error
+	switch ydbserverrpc.Compression(data[0]) {
+	case ydbserverrpc.CompressionNone:
+		return data[1:], nil
+	case ydbserverrpc.CompressionFlate:
+		r = flate.NewReader(payload)
+	case ydbserverrpc.CompressionGzip:
+		r, err = gzip.NewReader(payload)
+	case ydbserverrpc.CompressionZlib:
+		r, err = zlib.NewReader(payload)
+	default:
+		return nil, errUnknownCodec
+	}
+	if err != nil {
+		return nil, errCorruptSegment
+	}
+	defer r.Close()
+	block, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errCorruptSegment
+	}
+	return block, nil
+}
@@ -0,0 +1,211 @@
+package ydb
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/boylee1111/ydb/ydbserverrpc"
+)
+
+var errInvalidFilter = errors.New("Invalid filter.")
+
+// rowFilter is a compiled ydbserverrpc.Filter. It returns the columns of a
+// row that pass, none when the row is filtered out. Page filters count the
+// rows they pass, so a compiled filter serves one scan. Scan pages carry the
+// counts in their continuation tokens.
+type rowFilter interface {
+	filter(rowKey string, columns map[string][]YDBCell) map[string][]YDBCell
+}
+
+// compileFilter checks f and builds its evaluator, nil for no filter.
+func compileFilter(f *ydbserverrpc.Filter) (rowFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	switch f.Type {
+	case ydbserverrpc.FilterRowPrefix:
+		return &rowKeyFilter{match: func(key string) bool {
+			return strings.HasPrefix(key, f.Value)
+		}}, nil
+	case ydbserverrpc.FilterRowRegex:
+		re, err := regexp.Compile(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &rowKeyFilter{match: re.MatchString}, nil
+	case ydbserverrpc.FilterColumnValue:
+		if f.Column == "" || f.Op < ydbserverrpc.Equal || f.Op > ydbserverrpc.GreaterOrEqual {
+			return nil, errInvalidFilter
+		}
+		return &columnValueFilter{column: f.Column, op: f.Op, value: []byte(f.Value)}, nil
+	case ydbserverrpc.FilterQualifierPrefix:
+		return &columnFilter{match: func(key string) bool {
+			return strings.HasPrefix(key[strings.Index(key, ":")+1:], f.Value)
+		}}, nil
+	case ydbserverrpc.FilterFamily:
+		return &columnFilter{match: func(key string) bool {
+			return columnFamily(key) == f.Value
+		}}, nil
+	case ydbserverrpc.FilterFirstKeyOnly:
+		return firstKeyFilter{}, nil
+	case ydbserverrpc.FilterPage:
+		if f.Limit < 0 {
+			return nil, errInvalidFilter
+		}
+		return &pageFilter{limit: f.Limit}, nil
+	case ydbserverrpc.FilterAnd, ydbserverrpc.FilterOr:
+		list := &filterList{and: f.Type == ydbserverrpc.FilterAnd}
+		for i := range f.Filters {
+			operand, err := compileFilter(&f.Filters[i])
+			if err != nil {
+				return nil, err
+			}
+			list.filters = append(list.filters, operand)
+		}
+		return list, nil
+	}
+	return nil, errInvalidFilter
+}
+
+// rowKeyFilter passes whole rows by their key.
+type rowKeyFilter struct {
+	match func(key string) bool
+}
+
+func (f *rowKeyFilter) filter(rowKey string, columns map[string][]YDBCell) map[string][]YDBCell {
+	if f.match(rowKey) {
+		return columns
+	}
+	return nil
+}
+
+// columnValueFilter passes whole rows by the newest value of a column. Rows
+// without the column are filtered out.
+type columnValueFilter struct {
+	column string
+	op     ydbserverrpc.CompareOp
+	value  []byte
+}
+
+func (f *columnValueFilter) filter(rowKey string, columns map[string][]YDBCell) map[string][]YDBCell {
+	cells, ok := columns[f.column]
+	if !ok || len(cells) == 0 {
+		return nil
+	}
+	c := bytes.Compare(cells[0].Value, f.value)
+	var pass bool
+	switch f.op {
+	case ydbserverrpc.Equal:
+		pass = c == 0
+	case ydbserverrpc.NotEqual:
+		pass = c != 0
+	case ydbserverrpc.Less:
+		pass = c < 0
+	case ydbserverrpc.LessOrEqual:
+		pass = c <= 0
+	case ydbserverrpc.Greater:
+		pass = c > 0
+	case ydbserverrpc.GreaterOrEqual:
+		pass = c >= 0
+	}
+	if pass {
+		return columns
+	}
+	return nil
+}
+
+// columnFilter passes the matching columns of every row.
+type columnFilter struct {
+	match func(key string) bool
+}
+
+func (f *columnFilter) filter(rowKey string, columns map[string][]YDBCell) map[string][]YDBCell {
+	passed := make(map[string][]YDBCell)
+	for key, cells := range columns {
+		if f.match(key) {
+			passed[key] = cells
+		}
+	}
+	return passed
+}
+
+// firstKeyFilter passes the first column of every row in key order.
+type firstKeyFilter struct{}
+
+func (firstKeyFilter) filter(rowKey string, columns map[string][]YDBCell) map[string][]YDBCell {
+	if len(columns) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(columns))
+	for key := range columns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return map[string][]YDBCell{keys[0]: columns[keys[0]]}
+}
+
+// pageFilter passes the first limit rows it sees. The row that did not fit a
+// page is seen again at the start of the next one and counts only once.
+type pageFilter struct {
+	limit   int
+	passed  int
+	lastKey string // Last row passed
+}
+
+func (f *pageFilter) filter(rowKey string, columns map[string][]YDBCell) map[string][]YDBCell {
+	if len(columns) == 0 {
+		return nil
+	}
+	if f.passed > 0 && rowKey == f.lastKey {
+		return columns
+	}
+	if f.passed >= f.limit {
+		return nil
+	}
+	f.passed++
+	f.lastKey = rowKey
+	return columns
+}
+
+// pageFilters returns the page filters of f in order.
+func pageFilters(f rowFilter) []*pageFilter {
+	switch f := f.(type) {
+	case *pageFilter:
+		return []*pageFilter{f}
+	case *filterList:
+		pages := make([]*pageFilter, 0)
+		for _, operand := range f.filters {
+			pages = append(pages, pageFilters(operand)...)
+		}
+		return pages
+	}
+	return nil
+}
+
+// filterList chains its filters for AND, each one sees what the ones before
+// passed, and unites the columns they pass for OR.
+type filterList struct {
+	and     bool
+	filters []rowFilter
+}
+
+func (f *filterList) filter(rowKey string, columns map[string][]YDBCell) map[string][]YDBCell {
+	if f.and {
+		for _, operand := range f.filters {
+			if columns = operand.filter(rowKey, columns); len(columns) == 0 {
+				return nil
+			}
+		}
+		return columns
+	}
+	passed := make(map[string][]YDBCell)
+	for _, operand := range f.filters {
+		for key, cells := range operand.filter(rowKey, columns) {
+			passed[key] = cells
+		}
+	}
+	return passed
+}
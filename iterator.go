@@ -0,0 +1,101 @@
+package ydb
+
+// rowIterator walks rows in increasing row key order, or in decreasing order
+// once positioned by seekReverse.
+type rowIterator interface {
+	seek(start string)      // Position at the first row with key >= start
+	seekReverse(end string) // Position at the last row with key <= end, the last row for ""
+	next()                  // Move to the following row
+	valid() bool            // Whether the iterator points at a row
+	key() string
+	row() (YDBColumn, error)
+	err() error
+}
+
+// mergeIterator merges several row iterators into one ordered stream. The
+// children are ordered from oldest to newest, so when a row appears in more
+// than one child the newer columns win.
+type mergeIterator struct {
+	children []rowIterator
+	reverse  bool      // Walking towards smaller keys
+	columns  columnSet // Columns merged, nil for all
+	curKey   string
+	curRow   YDBColumn
+	lastErr  error
+	ok       bool
+}
+
+func newMergeIterator(children []rowIterator) *mergeIterator {
+	return &mergeIterator{children: children}
+}
+
+func (it *mergeIterator) seek(start string) {
+	it.reverse = false
+	for _, child := range it.children {
+		child.seek(start)
+	}
+	it.advance()
+}
+
+func (it *mergeIterator) seekReverse(end string) {
+	it.reverse = true
+	for _, child := range it.children {
+		child.seekReverse(end)
+	}
+	it.advance()
+}
+
+func (it *mergeIterator) next() {
+	it.advance()
+}
+
+// advance collects the smallest key of all children, the largest in reverse,
+// and steps every child positioned on it.
+func (it *mergeIterator) advance() {
+	it.ok = false
+	found := false
+	for _, child := range it.children {
+		if err := child.err(); err != nil {
+			it.lastErr = err
+			return
+		}
+		if child.valid() && (!found || (child.key() < it.curKey) != it.reverse) {
+			it.curKey = child.key()
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	it.curRow = newYDBColumn()
+	for _, child := range it.children {
+		if !child.valid() || child.key() != it.curKey {
+			continue
+		}
+		col, err := child.row()
+		if err != nil {
+			it.lastErr = err
+			return
+		}
+		it.curRow.mergeColumns(col, it.columns)
+		child.next()
+	}
+	it.ok = true
+}
+
+func (it *mergeIterator) valid() bool {
+	return it.ok
+}
+
+func (it *mergeIterator) key() string {
+	return it.curKey
+}
+
+func (it *mergeIterator) row() (YDBColumn, error) {
+	return it.curRow, nil
+}
+
+func (it *mergeIterator) err() error {
+	return it.lastErr
+}
@@ -41,9 +41,9 @@ func main() {
 		fmt.Println(err)
 	}
 
-	columns := make(map[string]string)
-	columns["Name:First Name"] = "Ivan"
-	columns["Name:Last Name"] = "Jie"
+	columns := make(map[string][]byte)
+	columns["Name:First Name"] = []byte("Ivan")
+	columns["Name:Last Name"] = []byte("Jie")
 	putRowArgs := &ydbserverrpc.PutRowArgs{
 		TableName:      tableName,
 		RowKey:         "testKey",
@@ -56,8 +56,8 @@ func main() {
 	fmt.Println("Put first record")
 
 	putRowArgs.RowKey = "testKey2"
-	columns["Name:First Name"] = "Huo"
-	columns["Name:Last Name"] = "Gun"
+	columns["Name:First Name"] = []byte("Huo")
+	columns["Name:Last Name"] = []byte("Gun")
 	if err := client.Call("YDBServer.PutRow", putRowArgs, &putRowReply); err != nil {
 		panic(err)
 	}
@@ -71,20 +71,22 @@ func main() {
 	if err := client.Call("YDBServer.GetRow", getRowAgrs, &getRowReply); err != nil {
 		panic(err)
 	}
-	fmt.Println(getRowReply.Row)
+	printCells(getRowReply.Cells)
 
 	getRowAgrs.RowKey = "testKey2"
+	getRowReply = ydbserverrpc.GetRowReply{}
 	if err := client.Call("YDBServer.GetRow", getRowAgrs, &getRowReply); err != nil {
 		panic(err)
 	}
-	fmt.Println(getRowReply.Row)
+	printCells(getRowReply.Cells)
 
 	// Get for non exist key
 	getRowAgrs.RowKey = "testKey_not_exist"
+	getRowReply = ydbserverrpc.GetRowReply{}
 	if err := client.Call("YDBServer.GetRow", getRowAgrs, &getRowReply); err != nil {
 		panic(err)
 	}
-	fmt.Println(getRowReply.Row)
+	printCells(getRowReply.Cells)
 
 	getRowsArgs := &ydbserverrpc.GetRowsArgs{
 		TableName:   tableName,
@@ -95,7 +97,10 @@ func main() {
 	if err := client.Call("YDBServer.GetRows", getRowsArgs, &getRowsReply); err != nil {
 		panic(err)
 	}
-	fmt.Println(getRowsReply.Rows)
+	for rowKey, cells := range getRowsReply.Cells {
+		fmt.Println(rowKey)
+		printCells(cells)
+	}
 
 	getColumnByRowArgs := &ydbserverrpc.GetColumnByRowArgs{
 		TableName:          tableName,
@@ -106,7 +111,7 @@ func main() {
 	if err := client.Call("YDBServer.GetColumnByRow", getColumnByRowArgs, &getColumnByRowReply); err != nil {
 		panic(err)
 	}
-	fmt.Println(getColumnByRowReply.Value)
+	fmt.Println(string(getColumnByRowReply.Value))
 
 	closeTableArgs := &ydbserverrpc.CloseTableArgs{
 		TableName: tableName,
@@ -124,3 +129,9 @@ func main() {
 		panic(err)
 	}
 }
+
+func printCells(cells []ydbserverrpc.Cell) {
+	for _, cell := range cells {
+		fmt.Printf("%s:%s = %s\n", cell.Family, cell.Qualifier, cell.Value)
+	}
+}
@@ -0,0 +1,198 @@
+package ydb
+
+import (
+	"math/rand"
+)
+
+// The memtable is a skiplist of rows sorted by row key, so it can be scanned
+// in key order like a segment. It keeps an approximate count of the bytes its
+// rows take, which the table compares against its memtable budget.
+
+const (
+	memTableMaxLevel     = 16 // Enough for 4^16 rows
+	memTableNodeOverhead = 64 // Approximate bytes of a node besides key and row
+)
+
+type memTableNode struct {
+	key  string
+	row  YDBColumn
+	next []*memTableNode // Successor on every level of the node
+}
+
+type memTable struct {
+	head   *memTableNode
+	level  int   // Levels in use
+	length int   // Number of rows
+	bytes  int64 // Approximate size of keys and rows
+}
+
+func newMemTable() *memTable {
+	return &memTable{
+		head:  &memTableNode{next: make([]*memTableNode, memTableMaxLevel)},
+		level: 1,
+	}
+}
+
+// randomLevel picks the level of a new node, each level a quarter as likely
+// as the one below.
+func randomLevel() int {
+	level := 1
+	for level < memTableMaxLevel && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// findGreaterOrEqual returns the first node with a key >= key, or nil. When
+// prev is not nil it receives the last node before it on every level.
+func (m *memTable) findGreaterOrEqual(key string, prev []*memTableNode) *memTableNode {
+	x := m.head
+	for level := m.level - 1; level >= 0; level-- {
+		for x.next[level] != nil && x.next[level].key < key {
+			x = x.next[level]
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+	return x.next[0]
+}
+
+// findLess returns the last node with a key < key, or <= key when orEqual is
+// set, or nil.
+func (m *memTable) findLess(key string, orEqual bool) *memTableNode {
+	x := m.head
+	for level := m.level - 1; level >= 0; level-- {
+		for n := x.next[level]; n != nil && (n.key < key || (orEqual && n.key == key)); n = x.next[level] {
+			x = n
+		}
+	}
+	if x == m.head {
+		return nil
+	}
+	return x
+}
+
+// findLast returns the node with the largest key, or nil.
+func (m *memTable) findLast() *memTableNode {
+	x := m.head
+	for level := m.level - 1; level >= 0; level-- {
+		for x.next[level] != nil {
+			x = x.next[level]
+		}
+	}
+	if x == m.head {
+		return nil
+	}
+	return x
+}
+
+func (m *memTable) get(key string) (YDBColumn, bool) {
+	if x := m.findGreaterOrEqual(key, nil); x != nil && x.key == key {
+		return x.row, true
+	}
+	return YDBColumn{}, false
+}
+
+// set stores row under key, replacing the row stored before.
+func (m *memTable) set(key string, row YDBColumn) {
+	prev := make([]*memTableNode, memTableMaxLevel)
+	if x := m.findGreaterOrEqual(key, prev); x != nil && x.key == key {
+		m.bytes += row.size() - x.row.size()
+		x.row = row
+		return
+	}
+	m.insert(prev, key, row)
+}
+
+// update changes the row under key in place through fn, starting from an
+// empty row when there is none.
+func (m *memTable) update(key string, fn func(row *YDBColumn)) {
+	prev := make([]*memTableNode, memTableMaxLevel)
+	if x := m.findGreaterOrEqual(key, prev); x != nil && x.key == key {
+		before := x.row.size()
+		fn(&x.row)
+		m.bytes += x.row.size() - before
+		return
+	}
+	row := newYDBColumn()
+	fn(&row)
+	m.insert(prev, key, row)
+}
+
+// insert links a node for a new key after the prev nodes found for it.
+func (m *memTable) insert(prev []*memTableNode, key string, row YDBColumn) {
+	level := randomLevel()
+	for ; m.level < level; m.level++ {
+		prev[m.level] = m.head
+	}
+	x := &memTableNode{key: key, row: row, next: make([]*memTableNode, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = prev[i].next[i]
+		prev[i].next[i] = x
+	}
+	m.length++
+	m.bytes += int64(len(key)) + row.size() + memTableNodeOverhead
+}
+
+func (m *memTable) len() int {
+	return m.length
+}
+
+// size returns the approximate bytes taken by the rows.
+func (m *memTable) size() int64 {
+	return m.bytes
+}
+
+func (m *memTable) iterator() *memTableIterator {
+	return &memTableIterator{table: m}
+}
+
+// memTableIterator walks the rows of a memtable in key order. The memtable
+// must not change while it is used.
+type memTableIterator struct {
+	table   *memTable
+	node    *memTableNode
+	reverse bool // Walking towards smaller keys
+}
+
+func (it *memTableIterator) seek(start string) {
+	it.reverse = false
+	it.node = it.table.findGreaterOrEqual(start, nil)
+}
+
+// seekReverse positions the iterator at the last row with key <= end, or at
+// the last row when end is empty. Nodes have no back links, so every step
+// backwards is a search.
+func (it *memTableIterator) seekReverse(end string) {
+	it.reverse = true
+	if end == "" {
+		it.node = it.table.findLast()
+		return
+	}
+	it.node = it.table.findLess(end, true)
+}
+
+func (it *memTableIterator) next() {
+	if it.reverse {
+		it.node = it.table.findLess(it.node.key, false)
+		return
+	}
+	it.node = it.node.next[0]
+}
+
+func (it *memTableIterator) valid() bool {
+	return it.node != nil
+}
+
+func (it *memTableIterator) key() string {
+	return it.node.key
+}
+
+func (it *memTableIterator) row() (YDBColumn, error) {
+	return it.node.row, nil
+}
+
+func (it *memTableIterator) err() error {
+	return nil
+}
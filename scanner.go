@@ -0,0 +1,168 @@
+package ydb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/boylee1111/ydb/ydbserverrpc"
+)
+
+const defaultScannerLease = time.Minute // Idle time after which a scanner is closed
+
+// scanner is an open server side scan. It reads the table as it was when the
+// scanner was opened: the segments of that moment holding the selected
+// families, which stay on disk while the scanner holds them, and a copy of
+// the memtables. Every call renews the lease, a scanner left idle longer is
+// closed.
+type scanner struct {
+	id       uint64
+	table    *ydbTable
+	segments []*segment // Held segments
+	it       rowIterator
+	options  scanOptions
+	r        versionRange
+	lease    time.Duration
+	timer    *time.Timer // Closes the scanner when the lease runs out
+	locker   *sync.Mutex // One page at a time
+	closed   bool
+}
+
+// openScanner takes a snapshot of the table and positions a scanner at the
+// start of the range.
+func (table *ydbTable) openScanner(id uint64, o scanOptions, r versionRange, lease time.Duration) *scanner {
+	table.dataLocker.RLock()
+	defer table.dataLocker.RUnlock()
+
+	sc := &scanner{
+		id:       id,
+		table:    table,
+		segments: make([]*segment, 0, len(table.segments)),
+		options:  o,
+		r:        r,
+		lease:    lease,
+		locker:   new(sync.Mutex),
+	}
+	children := make([]rowIterator, 0, len(table.segments)+2)
+	for _, seg := range table.segments {
+		if !seg.holds(o.columns) {
+			continue
+		}
+		seg.acquire()
+		sc.segments = append(sc.segments, seg)
+		children = append(children, seg.iterator())
+	}
+	// The frozen memtable never changes, the selected columns of the live one
+	// are copied
+	if table.immutable != nil {
+		children = append(children, table.immutable.iterator())
+	}
+	data := newMemTable()
+	rows := table.data.iterator()
+	for rows.seek(""); rows.valid(); rows.next() {
+		row, _ := rows.row()
+		col := newYDBColumn()
+		col.mergeColumns(row, o.columns)
+		data.set(rows.key(), col)
+	}
+	children = append(children, data.iterator())
+
+	it := newMergeIterator(children)
+	it.columns = o.columns
+	sc.it = it
+	if o.reverse {
+		sc.it.seekReverse(o.seekKey())
+	} else {
+		sc.it.seek(o.seekKey())
+	}
+	return sc
+}
+
+// next returns the following page of the scanner and whether rows are left.
+func (sc *scanner) next(limit int, byteLimit int64) ([]ydbserverrpc.ScanRow, bool, error) {
+	o := sc.options
+	o.limit, o.byteLimit = limit, byteLimit
+	sc.table.dataLocker.RLock()
+	defer sc.table.dataLocker.RUnlock()
+	return sc.table.readPage(sc.it, o, sc.r)
+}
+
+// close releases the segments of the scanner. Needs the scanner lock.
+func (sc *scanner) close() {
+	if sc.closed {
+		return
+	}
+	sc.closed = true
+	sc.timer.Stop()
+	for _, seg := range sc.segments {
+		seg.release()
+	}
+	sc.segments = nil
+	sc.it = nil
+}
+
+// addScanner registers sc and starts its lease.
+func (ydb *ydbServer) addScanner(sc *scanner) {
+	ydb.scannersLocker.Lock()
+	defer ydb.scannersLocker.Unlock()
+	ydb.scanners[sc.id] = sc
+	sc.timer = time.AfterFunc(sc.lease, func() {
+		ydb.closeScanner(sc.id)
+	})
+}
+
+// getScanner returns the scanner with the lock held and its lease renewed,
+// or nil when it is closed.
+func (ydb *ydbServer) getScanner(id uint64) *scanner {
+	ydb.scannersLocker.Lock()
+	sc, ok := ydb.scanners[id]
+	ydb.scannersLocker.Unlock()
+	if !ok {
+		return nil
+	}
+	sc.locker.Lock()
+	if sc.closed || !sc.renew() {
+		sc.locker.Unlock()
+		return nil
+	}
+	return sc
+}
+
+// renew restarts the lease of an open scanner. It fails when the lease ran
+// out already and the scanner is being closed. Needs the scanner lock.
+func (sc *scanner) renew() bool {
+	if !sc.timer.Stop() {
+		return false
+	}
+	sc.timer.Reset(sc.lease)
+	return true
+}
+
+// closeScanner closes and forgets a scanner, it reports whether it was open.
+func (ydb *ydbServer) closeScanner(id uint64) bool {
+	ydb.scannersLocker.Lock()
+	sc, ok := ydb.scanners[id]
+	delete(ydb.scanners, id)
+	ydb.scannersLocker.Unlock()
+	if !ok {
+		return false
+	}
+	sc.locker.Lock()
+	defer sc.locker.Unlock()
+	sc.close()
+	return true
+}
+
+// closeTableScanners closes the scanners of a table before it is closed.
+func (ydb *ydbServer) closeTableScanners(table *ydbTable) {
+	ydb.scannersLocker.Lock()
+	ids := make([]uint64, 0)
+	for id, sc := range ydb.scanners {
+		if sc.table == table {
+			ids = append(ids, id)
+		}
+	}
+	ydb.scannersLocker.Unlock()
+	for _, id := range ids {
+		ydb.closeScanner(id)
+	}
+}
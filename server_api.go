@@ -9,9 +9,21 @@ type YDBServer interface {
 	OpenTable(*ydbserverrpc.OpenTableArgs, *ydbserverrpc.OpenTableReply) error
 	CloseTable(*ydbserverrpc.CloseTableArgs, *ydbserverrpc.CloseTableReply) error
 	DestroyTable(*ydbserverrpc.DestroyTableArgs, *ydbserverrpc.DestroyTableReply) error
+	AlterTable(*ydbserverrpc.AlterTableArgs, *ydbserverrpc.AlterTableReply) error
 	PutRow(*ydbserverrpc.PutRowArgs, *ydbserverrpc.PutRowReply) error
+	DeleteRow(*ydbserverrpc.DeleteRowArgs, *ydbserverrpc.DeleteRowReply) error
+	DeleteColumns(*ydbserverrpc.DeleteColumnsArgs, *ydbserverrpc.DeleteColumnsReply) error
+	DeleteFamily(*ydbserverrpc.DeleteFamilyArgs, *ydbserverrpc.DeleteFamilyReply) error
 	GetRow(*ydbserverrpc.GetRowArgs, *ydbserverrpc.GetRowReply) error
 	GetRows(*ydbserverrpc.GetRowsArgs, *ydbserverrpc.GetRowsReply) error
+	Scan(*ydbserverrpc.ScanArgs, *ydbserverrpc.ScanReply) error
+	OpenScanner(*ydbserverrpc.OpenScannerArgs, *ydbserverrpc.OpenScannerReply) error
+	ScannerNext(*ydbserverrpc.ScannerNextArgs, *ydbserverrpc.ScannerNextReply) error
+	CloseScanner(*ydbserverrpc.CloseScannerArgs, *ydbserverrpc.CloseScannerReply) error
 	GetColumnByRow(*ydbserverrpc.GetColumnByRowArgs, *ydbserverrpc.GetColumnByRowReply) error
+	ConfigureTable(*ydbserverrpc.ConfigureTableArgs, *ydbserverrpc.ConfigureTableReply) error
 	MemTableLimit(*ydbserverrpc.MemTableLimitArgs, *ydbserverrpc.MemTableLimitReply) error
+	CompactTable(*ydbserverrpc.CompactTableArgs, *ydbserverrpc.CompactTableReply) error
+	GetCompactionProgress(*ydbserverrpc.GetCompactionProgressArgs, *ydbserverrpc.GetCompactionProgressReply) error
+	GetCacheStats(*ydbserverrpc.GetCacheStatsArgs, *ydbserverrpc.GetCacheStatsReply) error
 }
@@ -1,16 +1,24 @@
 package ydb
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/boylee1111/ydb/ydbserverrpc"
@@ -21,7 +29,16 @@ const (
 	defaultConnectionType  = "tcp"       // Default connection type for RPC
 	defaultHostname        = "localhost" // Default hostname
 	ydbServerRPCServerName = "YDBServer" // RPC name
-	defaultMemTableLimit   = 9000        // Default memory table row limit
+	defaultMemTableLimit   = 4 << 20     // Default memtable budget in bytes
+	tableMetaVersion       = 1           // Format of the table metadata written now
+	defaultScanLimit       = 1000        // Default rows of a Scan page
+	defaultScanByteLimit   = 4 << 20     // Default bytes of a Scan page
+	scanTokenTag           = 's'         // First byte of continuation tokens
+)
+
+const (
+	forwardTimeout = 5 * time.Second           // Bounds a call passed on to another node
+	rpcConnected   = "200 Connected to Go RPC" // HTTP status net/rpc answers a CONNECT with
 )
 
 type byNodeID []ydbserverrpc.ServerNode // Definition for Server node
@@ -50,6 +67,10 @@ type ydbServer struct {
 	registerLocker  *sync.RWMutex             // Mutex used for registering server
 	nodes           []ydbserverrpc.ServerNode // List of all nodes (master and slaves)
 	registeredCount int                       // Current registered node
+	blockCache      *blockCache               // Segment blocks shared by all tables
+	scanners        map[uint64]*scanner       // Scanner ID -> open scanner
+	scannersLocker  *sync.Mutex               // Mutex for scanners
+	lastScannerID   uint64                    // ID of the last opened scanner
 }
 
 type serverMeta struct {
@@ -57,6 +78,12 @@ type serverMeta struct {
 }
 
 func NewYDBServer(masterServerHostPort string, numNodes, port int, nodeID uint32) (YDBServer, error) {
+	return NewYDBServerWithCache(masterServerHostPort, numNodes, port, nodeID, defaultBlockCacheSize)
+}
+
+// NewYDBServerWithCache starts a server whose block cache holds up to
+// cacheSize bytes, 0 disables the cache.
+func NewYDBServerWithCache(masterServerHostPort string, numNodes, port int, nodeID uint32, cacheSize int64) (YDBServer, error) {
 	portStr := ":" + strconv.Itoa(port)
 	fmt.Println("portStr is " + portStr)
 	listener, err := net.Listen(defaultConnectionType, portStr)
@@ -81,10 +108,17 @@ func NewYDBServer(masterServerHostPort string, numNodes, port int, nodeID uint32
 		registerLocker:  new(sync.RWMutex),
 		nodes:           make([]ydbserverrpc.ServerNode, numNodes),
 		registeredCount: 0,
+		blockCache:      newBlockCache(cacheSize),
+		scanners:        make(map[uint64]*scanner),
+		scannersLocker:  new(sync.Mutex),
 	}
-	rpc.RegisterName(ydbServerRPCServerName, ydbserverrpc.Wrap(ydb))
-	rpc.HandleHTTP()
-	go http.Serve(listener, nil)
+	// Every server gets its own RPC server and mux so several nodes can run
+	// in one process.
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName(ydbServerRPCServerName, ydbserverrpc.Wrap(ydb))
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, rpcServer)
+	go http.Serve(listener, mux)
 	fmt.Println("Start serving...")
 
 	// Call master to join if it's from a slave server
@@ -144,7 +178,7 @@ func (ydb *ydbServer) RegisterServer(args *ydbserverrpc.RegisterServerArgs, repl
 
 	// Check whether the server is registered
 	isRegistered := false
-	for _, node := range ydb.nodes {
+	for _, node := range ydb.nodes[:ydb.registeredCount] {
 		if args.ServerInfo.NodeID == node.NodeID {
 			isRegistered = true
 		}
@@ -189,29 +223,43 @@ func (ydb *ydbServer) CreateTable(args *ydbserverrpc.CreateTableArgs, reply *ydb
 		return nil
 	}
 	if ydb.isTableExistOnDisk(args.TableName) {
-		reply.Status = ydbserverrpc.TableExist;
+		reply.Status = ydbserverrpc.TableExist
+		return nil
+	}
+
+	if !validTableName(args.TableName) || !validTableOptions(args.Options) {
+		reply.Status = ydbserverrpc.InvalidArgument
 		return nil
 	}
+	for i, family := range args.ColumnFamilies {
+		if !validFamily(family) || hasColumnFamily(args.ColumnFamilies[:i], family) {
+			reply.Status = ydbserverrpc.InvalidArgument
+			return nil
+		}
+	}
+	for family, options := range args.FamilyOptions {
+		if !validFamilyOptions(options) || !hasColumnFamily(args.ColumnFamilies, family) {
+			reply.Status = ydbserverrpc.InvalidArgument
+			return nil
+		}
+	}
 
 	// Create and serialize metadata to file
-	tableMetaFilename, tableDataFilename := formatFilename(args.TableName)
+	tableMetaFilename, _ := formatFilename(args.TableName)
 	metadata := TableMeta{
 		TableName:       args.TableName,
 		ColumnsFamilies: args.ColumnFamilies,
-		MemTableLimit:   defaultMemTableLimit,
 		CreationTime:    time.Now(),
+		FamilyOptions:   args.FamilyOptions,
+		Version:         tableMetaVersion,
 	}
+	metadata.setOptions(args.Options)
 	if err := writeGob(tableMetaFilename, metadata); err != nil {
 		return err
 	}
 
-	os.Create(tableDataFilename)
-
 	reply.Status = ydbserverrpc.OK
-	reply.TableHandle = ydbserverrpc.TableHandle{
-		TableName:      metadata.TableName,
-		ColumnFamilies: metadata.ColumnsFamilies,
-	}
+	reply.TableHandle = tableHandle(metadata)
 
 	return nil
 }
@@ -226,40 +274,65 @@ func (ydb *ydbServer) OpenTable(args *ydbserverrpc.OpenTableArgs, reply *ydbserv
 		return nil
 	}
 
-	tableMetaFilename, _ := formatFilename(args.TableName)
 	// Recovery metadata
-	var metadata = new(TableMeta)
-	if err := readGob(tableMetaFilename, metadata); err != nil {
+	metadata, err := readTableMeta(args.TableName)
+	if err != nil {
 		return err
 	}
-	dataStore := make(map[string]YDBColumn)
+	dataStore := newMemTable()
 
 	ydb.tables[metadata.TableName] = &ydbTable{
-		metadata:   *metadata,
-		data:       dataStore,
-		dataLocker: new(sync.RWMutex),
+		metadata:     *metadata,
+		data:         dataStore,
+		dataLocker:   new(sync.RWMutex),
+		configLocker: new(sync.Mutex),
 	}
 	table := ydb.tables[metadata.TableName]
-	table.recover()
-	reply.Status = ydbserverrpc.OK
-	reply.TableHandle = ydbserverrpc.TableHandle{
-		TableName:      metadata.TableName,
-		ColumnFamilies: metadata.ColumnsFamilies,
-		MemTableLimit:  metadata.MemTableLimit,
-		CreationTime:   metadata.CreationTime,
+	table.flushed = sync.NewCond(table.dataLocker)
+	if err := table.loadSegments(ydb); err != nil {
+		table.close()
+		delete(ydb.tables, metadata.TableName)
+		return err
 	}
+	if err := table.importLegacyData(ydb); err != nil {
+		table.close()
+		delete(ydb.tables, metadata.TableName)
+		return err
+	}
+	if err := table.recover(ydb); err != nil {
+		table.close()
+		delete(ydb.tables, metadata.TableName)
+		return err
+	}
+	if err := table.openWAL(); err != nil {
+		table.close()
+		delete(ydb.tables, metadata.TableName)
+		return err
+	}
+	table.startFlusher(ydb)
+	table.configLocker.Lock()
+	table.startCompaction(ydb)
+	table.configLocker.Unlock()
+	reply.Status = ydbserverrpc.OK
+	reply.TableHandle = tableHandle(*metadata)
 	return nil
 }
 
 func (ydb *ydbServer) CloseTable(args *ydbserverrpc.CloseTableArgs, reply *ydbserverrpc.CloseTableReply) error {
 	tableMetaFilename, _ := formatFilename(args.TableName)
 	if table, ok := ydb.tables[args.TableName]; ok {
-		if err := os.Remove(tableMetaFilename); err != nil {
+		if err := writeGob(tableMetaFilename, table.metadata); err != nil {
 			return err
 		}
-		writeGob(tableMetaFilename, table.metadata)
 
+		ydb.closeTableScanners(table)
+		table.configLocker.Lock()
+		table.stopCompaction()
+		table.configLocker.Unlock()
+		table.stopFlusher()
+		table.close()
 		delete(ydb.tables, args.TableName)
+		reply.Status = ydbserverrpc.OK
 		return nil
 	}
 
@@ -280,25 +353,83 @@ func (ydb *ydbServer) DestroyTable(args *ydbserverrpc.DestroyTableArgs, reply *y
 	if err := os.Remove(tableMetaFilename); err != nil {
 		return err
 	}
-	if err := os.Remove(tableDataFilename); err != nil {
+	if err := os.Remove(tableDataFilename); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	tableWAL := tableWALName(args.TableName)
-
-	if err := os.Remove(tableWAL); err != nil {
+	if err := os.Remove(tableLegacyWALName(args.TableName)); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	for _, id := range walFileIDs(args.TableName) {
+		if err := os.Remove(tableWALName(args.TableName, id)); err != nil {
+			return err
+		}
+	}
 
-	ydb.indexDB.Update(func(tx *bbolt.Tx) error {
+	err := ydb.indexDB.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(args.TableName))
+		if b == nil {
+			return nil
+		}
+		if segments := b.Bucket(segmentBucket); segments != nil {
+			segments.ForEach(func(k, v []byte) error {
+				path := tableSegmentName(args.TableName, binary.BigEndian.Uint64(k))
+				os.Remove(path)
+				ydb.blockCache.invalidate(path)
+				return nil
+			})
+		}
 		return tx.DeleteBucket([]byte(args.TableName))
 	})
+	if err != nil {
+		return err
+	}
 	reply.Status = ydbserverrpc.OK
 	return nil
 }
 
+func (ydb *ydbServer) AlterTable(args *ydbserverrpc.AlterTableArgs, reply *ydbserverrpc.AlterTableReply) error {
+	if table, ok := ydb.tables[args.TableName]; ok {
+		// Compaction must not bring back segments of dropped families
+		table.configLocker.Lock()
+		table.stopCompaction()
+		err := table.alter(ydb, args)
+		table.startCompaction(ydb)
+		table.configLocker.Unlock()
+		switch err {
+		case nil:
+		case errUnknownFamily:
+			reply.Status = ydbserverrpc.UnknownFamily
+			return nil
+		case errInvalidFamilies:
+			reply.Status = ydbserverrpc.InvalidArgument
+			return nil
+		default:
+			return err
+		}
+
+		table.dataLocker.RLock()
+		reply.TableHandle = tableHandle(table.metadata)
+		table.dataLocker.RUnlock()
+		reply.Status = ydbserverrpc.OK
+		return nil
+	}
+
+	reply.Status = ydbserverrpc.TableNotFound
+	return nil
+}
+
 func (ydb *ydbServer) PutRow(args *ydbserverrpc.PutRowArgs, reply *ydbserverrpc.PutRowReply) error {
+	if args.RowKey == "" || args.Timestamp < 0 || args.TTL < 0 {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
 	if table, ok := ydb.tables[args.TableName]; ok {
-		table.PutRow(ydb, args.RowKey, args.UpdatedColumns)
+		if err := table.PutRow(ydb, args.RowKey, args.UpdatedColumns, args.Timestamp, args.TTL); err == errUnknownFamily {
+			reply.Status = ydbserverrpc.UnknownFamily
+			return nil
+		} else if err != nil {
+			return err
+		}
 
 		reply.Status = ydbserverrpc.OK
 		return nil
@@ -308,12 +439,86 @@ func (ydb *ydbServer) PutRow(args *ydbserverrpc.PutRowArgs, reply *ydbserverrpc.
 	return nil
 }
 
+func (ydb *ydbServer) DeleteRow(args *ydbserverrpc.DeleteRowArgs, reply *ydbserverrpc.DeleteRowReply) error {
+	if args.RowKey == "" || args.Timestamp < 0 {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
+	if table, ok := ydb.tables[args.TableName]; ok {
+		if err := table.Delete(ydb, args.RowKey, walDeleteRow, nil, args.Timestamp); err != nil {
+			return err
+		}
+
+		reply.Status = ydbserverrpc.OK
+		return nil
+	}
+
+	reply.Status = ydbserverrpc.TableNotFound
+	return nil
+}
+
+func (ydb *ydbServer) DeleteColumns(args *ydbserverrpc.DeleteColumnsArgs, reply *ydbserverrpc.DeleteColumnsReply) error {
+	if args.RowKey == "" || args.Timestamp < 0 {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
+	if table, ok := ydb.tables[args.TableName]; ok {
+		if err := table.Delete(ydb, args.RowKey, walDeleteColumn, args.QualifiedColumnKeys, args.Timestamp); err == errUnknownFamily {
+			reply.Status = ydbserverrpc.UnknownFamily
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		reply.Status = ydbserverrpc.OK
+		return nil
+	}
+
+	reply.Status = ydbserverrpc.TableNotFound
+	return nil
+}
+
+func (ydb *ydbServer) DeleteFamily(args *ydbserverrpc.DeleteFamilyArgs, reply *ydbserverrpc.DeleteFamilyReply) error {
+	if args.RowKey == "" || args.Timestamp < 0 {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
+	if table, ok := ydb.tables[args.TableName]; ok {
+		if err := table.Delete(ydb, args.RowKey, walDeleteFamily, []string{args.Family}, args.Timestamp); err == errUnknownFamily {
+			reply.Status = ydbserverrpc.UnknownFamily
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		reply.Status = ydbserverrpc.OK
+		return nil
+	}
+
+	reply.Status = ydbserverrpc.TableNotFound
+	return nil
+}
+
 func (ydb *ydbServer) GetRow(args *ydbserverrpc.GetRowArgs, reply *ydbserverrpc.GetRowReply) error {
+	columns, err := newColumnSet(args.Columns)
+	if args.MaxVersions < 0 || err != nil {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
 	if table, ok := ydb.tables[args.TableName]; ok {
-		value := table.GetRow(ydb, args.RowKey)
+		row, err := table.GetRow(ydb, args.RowKey, versionRange{
+			maxVersions:  args.MaxVersions,
+			minTimestamp: args.MinTimestamp,
+			maxTimestamp: args.MaxTimestamp,
+		}, columns)
+		if err != nil {
+			return err
+		}
 
 		reply.Status = ydbserverrpc.OK
-		reply.Row = value
+		reply.Cells = row.Cells
+		reply.Row = row.Row
+		reply.Versions = row.Versions
 		return nil
 	} // TODO: add record, check mem size
 
@@ -322,11 +527,35 @@ func (ydb *ydbServer) GetRow(args *ydbserverrpc.GetRowArgs, reply *ydbserverrpc.
 }
 
 func (ydb *ydbServer) GetRows(args *ydbserverrpc.GetRowsArgs, reply *ydbserverrpc.GetRowsReply) error {
+	columns, columnsErr := newColumnSet(args.Columns)
+	filter, err := compileFilter(args.Filter)
+	if args.MaxVersions < 0 || columnsErr != nil || err != nil {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
 	if table, ok := ydb.tables[args.TableName]; ok {
-		values := table.GetRows(ydb, args.StartRowKey, args.EndRowKey)
+		rows, err := table.GetRows(ydb, args.StartRowKey, args.EndRowKey, versionRange{
+			maxVersions:  args.MaxVersions,
+			minTimestamp: args.MinTimestamp,
+			maxTimestamp: args.MaxTimestamp,
+		}, columns, filter)
+		if err != nil {
+			return err
+		}
 
 		reply.Status = ydbserverrpc.OK
-		reply.Rows = values
+		reply.Cells = make(map[string][]ydbserverrpc.Cell)
+		reply.Rows = make(map[string]string)
+		if args.MaxVersions > 0 {
+			reply.Versions = make(map[string]string)
+		}
+		for _, row := range rows {
+			reply.Cells[row.RowKey] = row.Cells
+			reply.Rows[row.RowKey] = row.Row
+			if args.MaxVersions > 0 {
+				reply.Versions[row.RowKey] = row.Versions
+			}
+		}
 		return nil
 	}
 
@@ -334,12 +563,54 @@ func (ydb *ydbServer) GetRows(args *ydbserverrpc.GetRowsArgs, reply *ydbserverrp
 	return nil
 }
 
-func (ydb *ydbServer) GetColumnByRow(args *ydbserverrpc.GetColumnByRowArgs, reply *ydbserverrpc.GetColumnByRowReply) error {
+func (ydb *ydbServer) Scan(args *ydbserverrpc.ScanArgs, reply *ydbserverrpc.ScanReply) error {
+	columns, columnsErr := newColumnSet(args.Columns)
+	filter, err := compileFilter(args.Filter)
+	if args.Limit < 0 || args.ByteLimit < 0 || args.MaxVersions < 0 || columnsErr != nil || err != nil {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
+	o := scanOptions{
+		start:     args.StartRowKey,
+		end:       args.EndRowKey,
+		prefix:    args.Prefix,
+		reverse:   args.Reverse,
+		limit:     args.Limit,
+		byteLimit: args.ByteLimit,
+		columns:   columns,
+		filter:    filter,
+	}
+	if o.limit == 0 {
+		o.limit = defaultScanLimit
+	}
+	if o.byteLimit == 0 {
+		o.byteLimit = defaultScanByteLimit
+	}
+	if args.ContinuationToken != "" {
+		after, err := decodeScanToken(args.ContinuationToken, pageFilters(filter))
+		if err != nil {
+			reply.Status = ydbserverrpc.InvalidArgument
+			return nil
+		}
+		o.resume, o.after = true, after
+	}
+
 	if table, ok := ydb.tables[args.TableName]; ok {
-		value := table.GetColumnByRow(ydb, args.RowKey, args.QualifiedColumnKey)
+		rows, more, err := table.Scan(ydb, o, versionRange{
+			maxVersions:  args.MaxVersions,
+			minTimestamp: args.MinTimestamp,
+			maxTimestamp: args.MaxTimestamp,
+		})
+		if err != nil {
+			return err
+		}
 
 		reply.Status = ydbserverrpc.OK
-		reply.Value = value
+		reply.Rows = rows
+		reply.Done = !more
+		if more {
+			reply.ContinuationToken = encodeScanToken(rows[len(rows)-1].RowKey, pageFilters(filter))
+		}
 		return nil
 	}
 
@@ -347,28 +618,316 @@ func (ydb *ydbServer) GetColumnByRow(args *ydbserverrpc.GetColumnByRowArgs, repl
 	return nil
 }
 
-func (ydb *ydbServer) MemTableLimit(args *ydbserverrpc.MemTableLimitArgs, reply *ydbserverrpc.MemTableLimitReply) error {
-	tableMetaFilename, _ := formatFilename(args.TableName)
+func (ydb *ydbServer) OpenScanner(args *ydbserverrpc.OpenScannerArgs, reply *ydbserverrpc.OpenScannerReply) error {
+	columns, columnsErr := newColumnSet(args.Columns)
+	filter, err := compileFilter(args.Filter)
+	if args.MaxVersions < 0 || args.Lease < 0 || columnsErr != nil || err != nil {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
+	lease := args.Lease
+	if lease == 0 {
+		lease = defaultScannerLease
+	}
+
 	if table, ok := ydb.tables[args.TableName]; ok {
-		tableMeta := table.metadata
-		tableMeta.MemTableLimit = args.NewLimitRows
+		sc := table.openScanner(atomic.AddUint64(&ydb.lastScannerID, 1), scanOptions{
+			start:   args.StartRowKey,
+			end:     args.EndRowKey,
+			prefix:  args.Prefix,
+			reverse: args.Reverse,
+			columns: columns,
+			filter:  filter,
+		}, versionRange{
+			maxVersions:  args.MaxVersions,
+			minTimestamp: args.MinTimestamp,
+			maxTimestamp: args.MaxTimestamp,
+		}, lease)
+		ydb.addScanner(sc)
+
+		reply.Status = ydbserverrpc.OK
+		reply.ScannerID = sc.id
+		reply.Lease = lease
+		return nil
+	}
+
+	reply.Status = ydbserverrpc.TableNotFound
+	return nil
+}
+
+func (ydb *ydbServer) ScannerNext(args *ydbserverrpc.ScannerNextArgs, reply *ydbserverrpc.ScannerNextReply) error {
+	if args.Limit < 0 || args.ByteLimit < 0 {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
+	limit, byteLimit := args.Limit, args.ByteLimit
+	if limit == 0 {
+		limit = defaultScanLimit
+	}
+	if byteLimit == 0 {
+		byteLimit = defaultScanByteLimit
+	}
+
+	sc := ydb.getScanner(args.ScannerID)
+	if sc == nil {
+		reply.Status = ydbserverrpc.ScannerNotFound
+		return nil
+	}
+	rows, more, err := sc.next(limit, byteLimit)
+	sc.locker.Unlock()
+	if err != nil {
+		return err
+	}
+	// A scanner is done with its last page
+	if !more {
+		ydb.closeScanner(args.ScannerID)
+	}
+
+	reply.Status = ydbserverrpc.OK
+	reply.Rows = rows
+	reply.Done = !more
+	return nil
+}
+
+func (ydb *ydbServer) CloseScanner(args *ydbserverrpc.CloseScannerArgs, reply *ydbserverrpc.CloseScannerReply) error {
+	if !ydb.closeScanner(args.ScannerID) {
+		reply.Status = ydbserverrpc.ScannerNotFound
+		return nil
+	}
+	reply.Status = ydbserverrpc.OK
+	return nil
+}
+
+// encodeScanToken returns the continuation token of a page ending at rowKey.
+// It holds the counts of the page filters of the scan, followed by the key.
+func encodeScanToken(rowKey string, pages []*pageFilter) string {
+	buf := bytes.NewBuffer([]byte{scanTokenTag})
+	for _, page := range pages {
+		putUvarint(buf, uint64(page.passed))
+		putString(buf, page.lastKey)
+	}
+	buf.WriteString(rowKey)
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
 
-		if err := os.Remove(tableMetaFilename); err != nil {
+// decodeScanToken returns the key the page of token ended at and restores
+// the counts of pages.
+func decodeScanToken(token string, pages []*pageFilter) (string, error) {
+	errToken := errors.New("Invalid continuation token.")
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 || data[0] != scanTokenTag {
+		return "", errToken
+	}
+	reader := bytes.NewReader(data[1:])
+	for _, page := range pages {
+		passed, err := binary.ReadUvarint(reader)
+		if err != nil || passed > uint64(page.limit) {
+			return "", errToken
+		}
+		if page.lastKey, err = readString(reader); err != nil {
+			return "", errToken
+		}
+		page.passed = int(passed)
+	}
+	return string(data[len(data)-reader.Len():]), nil
+}
+
+func (ydb *ydbServer) GetColumnByRow(args *ydbserverrpc.GetColumnByRowArgs, reply *ydbserverrpc.GetColumnByRowReply) error {
+	if table, ok := ydb.tables[args.TableName]; ok {
+		value, err := table.GetColumnByRow(ydb, args.RowKey, args.QualifiedColumnKey)
+		if err != nil {
 			return err
 		}
-		writeGob(tableMetaFilename, table.metadata)
 
 		reply.Status = ydbserverrpc.OK
+		reply.Value = value
 		return nil
 	}
-	if ydb.isTableExistOnDisk(args.TableName) {
-		var tableMeta = new(TableMeta)
-		readGob(tableMetaFilename, tableMeta)
 
-		if err := os.Remove(tableMetaFilename); err != nil {
-			return err
+	reply.Status = ydbserverrpc.TableNotFound
+	return nil
+}
+
+func (ydb *ydbServer) ConfigureTable(args *ydbserverrpc.ConfigureTableArgs, reply *ydbserverrpc.ConfigureTableReply) error {
+	if !validTableOptions(args.Options) {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
+	handle, status, err := ydb.configureTable(args.TableName, func(options *ydbserverrpc.TableOptions) {
+		*options = args.Options
+	})
+	if err != nil {
+		return err
+	}
+	reply.TableHandle = handle
+	reply.Status = status
+	if args.Forwarded {
+		return nil
+	}
+
+	forwarded := *args
+	forwarded.Forwarded = true
+	reply.Nodes = ydb.forward(func(client *rpc.Client) (ydbserverrpc.Status, error) {
+		var nodeReply ydbserverrpc.ConfigureTableReply
+		err := client.Call("YDBServer.ConfigureTable", &forwarded, &nodeReply)
+		return nodeReply.Status, err
+	})
+	reply.Status, reply.FailedNodes = clusterStatus(reply.Status, reply.Nodes)
+	return nil
+}
+
+func (ydb *ydbServer) MemTableLimit(args *ydbserverrpc.MemTableLimitArgs, reply *ydbserverrpc.MemTableLimitReply) error {
+	if args.NewLimitBytes <= 0 {
+		reply.Status = ydbserverrpc.InvalidArgument
+		return nil
+	}
+	_, status, err := ydb.configureTable(args.TableName, func(options *ydbserverrpc.TableOptions) {
+		options.MemTableLimit = args.NewLimitBytes
+	})
+	if err != nil {
+		return err
+	}
+	reply.Status = status
+	if args.Forwarded {
+		return nil
+	}
+
+	forwarded := *args
+	forwarded.Forwarded = true
+	reply.Nodes = ydb.forward(func(client *rpc.Client) (ydbserverrpc.Status, error) {
+		var nodeReply ydbserverrpc.MemTableLimitReply
+		err := client.Call("YDBServer.MemTableLimit", &forwarded, &nodeReply)
+		return nodeReply.Status, err
+	})
+	reply.Status, reply.FailedNodes = clusterStatus(reply.Status, reply.Nodes)
+	return nil
+}
+
+// configureTable changes the options of a table of this node, open or not,
+// with update. The status is TableNotFound when the node does not host it.
+func (ydb *ydbServer) configureTable(tableName string, update func(options *ydbserverrpc.TableOptions)) (ydbserverrpc.TableHandle, ydbserverrpc.Status, error) {
+	if table, ok := ydb.tables[tableName]; ok {
+		table.configLocker.Lock()
+		defer table.configLocker.Unlock()
+		table.dataLocker.RLock()
+		options := table.metadata.options()
+		table.dataLocker.RUnlock()
+		update(&options)
+
+		// Compaction reads the options as it goes
+		table.stopCompaction()
+		err := table.configure(options)
+		table.startCompaction(ydb)
+		if err != nil {
+			return ydbserverrpc.TableHandle{}, 0, err
+		}
+
+		table.dataLocker.RLock()
+		defer table.dataLocker.RUnlock()
+		return tableHandle(table.metadata), ydbserverrpc.OK, nil
+	}
+	if !ydb.isTableExistOnDisk(tableName) {
+		return ydbserverrpc.TableHandle{}, ydbserverrpc.TableNotFound, nil
+	}
+
+	metadata, err := readTableMeta(tableName)
+	if err != nil {
+		return ydbserverrpc.TableHandle{}, 0, err
+	}
+	options := metadata.options()
+	update(&options)
+	metadata.setOptions(options)
+	tableMetaFilename, _ := formatFilename(tableName)
+	if err := writeGob(tableMetaFilename, metadata); err != nil {
+		return ydbserverrpc.TableHandle{}, 0, err
+	}
+	return tableHandle(*metadata), ydbserverrpc.OK, nil
+}
+
+// forward makes call on every other node at once and collects their replies.
+// Nodes that cannot be reached within forwardTimeout are reported
+// NodeUnavailable.
+func (ydb *ydbServer) forward(call func(client *rpc.Client) (ydbserverrpc.Status, error)) []ydbserverrpc.NodeStatus {
+	ydb.registerLocker.RLock()
+	nodes := make([]ydbserverrpc.NodeStatus, 0, len(ydb.nodes))
+	for _, node := range ydb.nodes {
+		if node.NodeID != ydb.nodeID && node.HostPort != "" {
+			nodes = append(nodes, ydbserverrpc.NodeStatus{Node: node})
+		}
+	}
+	ydb.registerLocker.RUnlock()
+
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Add(1)
+		go func(node *ydbserverrpc.NodeStatus) {
+			defer wg.Done()
+			client, err := dialNode(node.Node.HostPort, forwardTimeout)
+			if err == nil {
+				node.Status, err = call(client)
+				client.Close()
+			}
+			if err != nil {
+				node.Status = ydbserverrpc.NodeUnavailable
+				node.Error = err.Error()
+			}
+		}(&nodes[i])
+	}
+	wg.Wait()
+	return nodes
+}
+
+// clusterStatus is the status of a call passed on to the other nodes, with
+// the nodes it failed on. Nodes that do not host the table have nothing to
+// apply. The status is NodeUnavailable when the call failed on any node, or
+// else OK when any node, this one or another, applied it.
+func clusterStatus(local ydbserverrpc.Status, nodes []ydbserverrpc.NodeStatus) (ydbserverrpc.Status, []ydbserverrpc.ServerNode) {
+	var failed []ydbserverrpc.ServerNode
+	status := local
+	for _, node := range nodes {
+		switch node.Status {
+		case ydbserverrpc.OK:
+			status = ydbserverrpc.OK
+		case ydbserverrpc.TableNotFound:
+		default:
+			failed = append(failed, node.Node)
 		}
-		writeGob(tableMetaFilename, tableMeta)
+	}
+	if len(failed) > 0 {
+		return ydbserverrpc.NodeUnavailable, failed
+	}
+	return status, nil
+}
+
+// dialNode connects to the RPC server of a node like rpc.DialHTTP, but gives
+// up on the connection, and on the calls made over it, after timeout.
+func dialNode(hostPort string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout(defaultConnectionType, hostPort, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != rpcConnected {
+		err = errors.New("Unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func (ydb *ydbServer) CompactTable(args *ydbserverrpc.CompactTableArgs, reply *ydbserverrpc.CompactTableReply) error {
+	if table, ok := ydb.tables[args.TableName]; ok {
+		table.configLocker.Lock()
+		table.requestCompaction()
+		reply.Progress = table.compactionProgress()
+		table.configLocker.Unlock()
 
 		reply.Status = ydbserverrpc.OK
 		return nil
@@ -378,35 +937,150 @@ func (ydb *ydbServer) MemTableLimit(args *ydbserverrpc.MemTableLimitArgs, reply
 	return nil
 }
 
-func tableWALName(tableName string) string {
+func (ydb *ydbServer) GetCompactionProgress(args *ydbserverrpc.GetCompactionProgressArgs, reply *ydbserverrpc.GetCompactionProgressReply) error {
+	if table, ok := ydb.tables[args.TableName]; ok {
+		table.configLocker.Lock()
+		reply.Progress = table.compactionProgress()
+		table.configLocker.Unlock()
+		reply.Status = ydbserverrpc.OK
+		return nil
+	}
+
+	reply.Status = ydbserverrpc.TableNotFound
+	return nil
+}
+
+func (ydb *ydbServer) GetCacheStats(args *ydbserverrpc.GetCacheStatsArgs, reply *ydbserverrpc.GetCacheStatsReply) error {
+	reply.Status = ydbserverrpc.OK
+	reply.Stats = ydb.blockCache.stats()
+	return nil
+}
+
+func tableWALName(tableName string, id uint64) string {
+	return "./" + tableName + "." + strconv.FormatUint(id, 10) + ".wal"
+}
+
+// tableLegacyWALName returns the single WAL file of older versions.
+func tableLegacyWALName(tableName string) string {
 	return "./" + tableName + ".wal"
 }
 
+func tableSegmentName(tableName string, id uint64) string {
+	return "./" + tableName + "." + strconv.FormatUint(id, 10) + ".sst"
+}
+
+// formatFilename returns the metadata file and the legacy line based data
+// file of a table.
 func formatFilename(tableName string) (string, string) {
 	return "./" + tableName + ".meta", "./" + tableName + ".ydb"
 }
 
+// tableHandle describes a table to clients.
+func tableHandle(metadata TableMeta) ydbserverrpc.TableHandle {
+	return ydbserverrpc.TableHandle{
+		TableName:      metadata.TableName,
+		ColumnFamilies: metadata.ColumnsFamilies,
+		FamilyOptions:  metadata.FamilyOptions,
+		Options:        metadata.options(),
+		MemTableLimit:  metadata.MemTableLimit,
+		CreationTime:   metadata.CreationTime,
+	}
+}
+
+// validTableName tells whether name can name a table. The files of a table
+// are named by the table name, a dot and a suffix, so a dot in a table name
+// could make the files of two tables look alike.
+func validTableName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "./")
+}
+
+// validFamily tells whether name can name a column family.
+func validFamily(name string) bool {
+	return name != "" && !strings.Contains(name, ":")
+}
+
+func validFamilyOptions(options ydbserverrpc.ColumnFamilyOptions) bool {
+	return options.MaxVersions >= 0 && options.TTL >= 0 && validCompression(options.Compression)
+}
+
+func validTableOptions(options ydbserverrpc.TableOptions) bool {
+	return options.MemTableLimit >= 0 &&
+		options.WALSyncPolicy >= ydbserverrpc.SyncGroup && options.WALSyncPolicy <= ydbserverrpc.SyncInterval &&
+		options.WALSyncInterval >= 0 && options.WALSegmentSize >= 0 &&
+		validCompression(options.Compression) &&
+		options.BloomFalsePositive >= 0 && options.BloomFalsePositive < 1 &&
+		options.MaxVersions >= 0 && options.TTL >= 0 &&
+		options.Compaction >= ydbserverrpc.CompactionSizeTiered && options.Compaction <= ydbserverrpc.CompactionManual &&
+		// A run of one segment would be merged again and again
+		(options.CompactionMinSegments == 0 || options.CompactionMinSegments >= 2 && options.CompactionMinSegments <= compactionMaxSegments)
+}
+
+func hasColumnFamily(families []string, family string) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
 func (ydb *ydbServer) isTableExistOnDisk(tableName string) bool {
-	tableMetaFilename, tableDataFilename := formatFilename(tableName)
+	tableMetaFilename, _ := formatFilename(tableName)
 	if _, err := os.Stat(tableMetaFilename); os.IsNotExist(err) {
 		return false
 	}
-	if _, err := os.Stat(tableDataFilename); os.IsNotExist(err) {
-		return false
-	}
 	return true
 }
 
+// writeGob saves object to filePath atomically: it is written to a temporary
+// file, synced and renamed over filePath, so a crash leaves either the old or
+// the new file. The directory is synced too, so the rename survives a crash.
 func writeGob(filePath string, object interface{}) error {
-	file, err := os.Create(filePath)
-	if err == nil {
-		encoder := gob.NewEncoder(file)
-		encoder.Encode(object)
+	tmpPath := filePath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(file).Encode(object); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
 	}
-	file.Close()
 	return err
 }
 
+// readTableMeta reads the metadata of a table and brings it to the current
+// format.
+func readTableMeta(tableName string) (*TableMeta, error) {
+	tableMetaFilename, _ := formatFilename(tableName)
+	metadata := new(TableMeta)
+	if err := readGob(tableMetaFilename, metadata); err != nil {
+		return nil, err
+	}
+	// Version 0 counted the memtable limit in rows, the same for every table
+	if metadata.Version < 1 {
+		metadata.MemTableLimit = defaultMemTableLimit
+	}
+	metadata.Version = tableMetaVersion
+	return metadata, nil
+}
+
 func readGob(filePath string, object interface{}) error {
 	file, err := os.Open(filePath)
 	if err == nil {
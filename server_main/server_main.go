@@ -21,7 +21,13 @@ func main() {
 
 	fmt.Println("Starting server...")
 	done := make(chan bool)
-	ydb.NewYDBServer(masterHostPort, numNodes, port, nodeId)
+	if len(args) > 4 {
+		// Optional block cache size in MB
+		cacheMB, _ := strconv.Atoi(args[4])
+		ydb.NewYDBServerWithCache(masterHostPort, numNodes, port, nodeId, int64(cacheMB)*1024*1024)
+	} else {
+		ydb.NewYDBServer(masterHostPort, numNodes, port, nodeId)
+	}
 	fmt.Println("Server started.")
 	<-done
 }
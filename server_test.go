@@ -1,12 +1,24 @@
 package ydb
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/boylee1111/ydb/ydbserverrpc"
 	"github.com/phayes/freeport"
+	"go.etcd.io/bbolt"
+	"io/ioutil"
 	"math/rand"
 	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -16,61 +28,2543 @@ const (
 	N            = 10000
 	tableName    = "testTable"
 	clientNumber = 10
+	testDBName   = "index_db0"
+
+	testNodeDirEnv    = "YDB_TEST_NODE_DIR"    // Working directory of a slave node process
+	testNodeMasterEnv = "YDB_TEST_NODE_MASTER" // Master of a slave node process
+	testNodePortEnv   = "YDB_TEST_NODE_PORT"   // Port of a slave node process
+)
+
+var (
+	testServerOnce sync.Once
+	testServer     *ydbServer // Shared by all tests, a process can open the index db once
+	testServerAddr string
 )
 
-// Single client Testing
+func TestMain(m *testing.M) {
+	// The multi-node tests start the slave nodes in processes of their own
+	if dir := os.Getenv(testNodeDirEnv); dir != "" {
+		runTestNode(dir)
+		return
+	}
+	os.Remove(testDBName)
+	code := m.Run()
+	os.Remove(testDBName)
+	os.Exit(code)
+}
+
+// Single client Testing
+
+func TestYdbServer_GetRow(t *testing.T) {
+	client := serverStartup()
+	putRowRecords(client, N)
+
+	start := time.Now()
+	getRowRecords(client, N)
+	end := time.Now()
+	diff := end.Sub(start)
+	fmt.Printf("Test GetRow for %d times, take %v.\n", N, diff)
+
+	serverCloseAndCleanup(client)
+}
+
+func TestYdbServer_PutRow(t *testing.T) {
+	client := serverStartup()
+
+	start := time.Now()
+	putRowRecords(client, N)
+	end := time.Now()
+	diff := end.Sub(start)
+	fmt.Printf("Test PutRow for %d times, take %v.\n", N, diff)
+
+	serverCloseAndCleanup(client)
+}
+
+func TestYdbServer_GetRows(t *testing.T) {
+	client := serverStartup()
+	putRowRecords(client, N)
+
+	start := time.Now()
+	getRowsRecords(client, N)
+	end := time.Now()
+	diff := end.Sub(start)
+
+	fmt.Printf("Test GetRows for %d times, take %v.\n", N, diff)
+
+	serverCloseAndCleanup(client)
+}
+
+func TestYdbServer_GetRows_MemTable(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+	table.dataLocker.Lock()
+	table.metadata.FamilyOptions = map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {MaxVersions: 2}}
+	table.dataLocker.Unlock()
+	name := func(value string) map[string]string {
+		return map[string]string{"Name:First Name": value}
+	}
+
+	// Rows spread over a segment, a frozen memtable and the live memtable
+	putRowAt(t, client, "a1", name("Segment"), 10)
+	putRowAt(t, client, "a2", name("Segment"), 10)
+	table.dataLocker.Lock()
+	err := table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.stopFlusher()
+	putRowAt(t, client, "a1", name("Frozen"), 20)
+	putRowAt(t, client, "b1", name("Frozen"), 20)
+	table.dataLocker.Lock()
+	err = table.freeze()
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRowAt(t, client, "b1", name("Live"), 30)
+	putRowAt(t, client, "c1", name("Live"), 30)
+	var deleteRowReply ydbserverrpc.DeleteRowReply
+	if err := client.Call("YDBServer.DeleteRow", &ydbserverrpc.DeleteRowArgs{TableName: tableName, RowKey: "a2", Timestamp: 30}, &deleteRowReply); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRows := func(stage string) {
+		getRowsArgs := &ydbserverrpc.GetRowsArgs{TableName: tableName, StartRowKey: "a", EndRowKey: "z", MaxVersions: 2}
+		var getRowsReply ydbserverrpc.GetRowsReply
+		if err := client.Call("YDBServer.GetRows", getRowsArgs, &getRowsReply); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"a1": "Frozen", "b1": "Live", "c1": "Live"}
+		if len(getRowsReply.Rows) != len(want) {
+			t.Errorf("%s: got rows %v", stage, getRowsReply.Rows)
+		}
+		for rowKey, value := range want {
+			row := make(map[string]string)
+			json.Unmarshal([]byte(getRowsReply.Rows[rowKey]), &row)
+			if row["Name:First Name"] != value {
+				t.Errorf("%s: row %s is %v, want %s", stage, rowKey, row, value)
+			}
+		}
+		versions := make(map[string][]jsonCell)
+		json.Unmarshal([]byte(getRowsReply.Versions["b1"]), &versions)
+		if cells := versions["Name:First Name"]; len(cells) != 2 || cells[1].Value != "Frozen" {
+			t.Errorf("%s: wrong versions of b1 %v", stage, cells)
+		}
+	}
+	checkRows("memtable")
+	table.startFlusher(testServer)
+	table.dataLocker.Lock()
+	err = table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRows("flushed")
+	reopenTable(t, client, tableName)
+	checkRows("reopened")
+}
+
+func TestYdbServer_Scan(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+
+	// Rows on disk and in the memtable, some deleted, and keys outside the prefix
+	want := make([]string, 0)
+	for i := 0; i < 50; i++ {
+		rowKey := fmt.Sprintf("row%02d", i)
+		putRow(t, client, rowKey, map[string]string{"Name:First Name": rowKey})
+		if i != 10 && i != 35 {
+			want = append(want, rowKey)
+		}
+		if i == 29 {
+			table.dataLocker.Lock()
+			err := table.flush(testServer)
+			table.dataLocker.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	putRow(t, client, "a", map[string]string{"Name:First Name": "a"})
+	putRow(t, client, "z", map[string]string{"Name:First Name": "z"})
+	var deleteRowReply ydbserverrpc.DeleteRowReply
+	for _, rowKey := range []string{"row10", "row35"} {
+		if err := client.Call("YDBServer.DeleteRow", &ydbserverrpc.DeleteRowArgs{TableName: tableName, RowKey: rowKey}, &deleteRowReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scanAll := func(args ydbserverrpc.ScanArgs) ([]string, int) {
+		args.TableName = tableName
+		keys := make([]string, 0)
+		for pages := 1; ; pages++ {
+			var reply ydbserverrpc.ScanReply
+			if err := client.Call("YDBServer.Scan", &args, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Status != ydbserverrpc.OK {
+				t.Fatalf("Scan failed with status %d.", reply.Status)
+			}
+			if args.Limit > 0 && len(reply.Rows) > args.Limit {
+				t.Errorf("Page of %d rows over the limit %d.", len(reply.Rows), args.Limit)
+			}
+			for _, row := range reply.Rows {
+				value := make(map[string]string)
+				json.Unmarshal([]byte(row.Row), &value)
+				if value["Name:First Name"] != row.RowKey {
+					t.Errorf("Wrong row %s: %v", row.RowKey, value)
+				}
+				keys = append(keys, row.RowKey)
+			}
+			if reply.Done {
+				if reply.ContinuationToken != "" {
+					t.Error("Continuation token on the last page.")
+				}
+				return keys, pages
+			}
+			args.ContinuationToken = reply.ContinuationToken
+		}
+	}
+	reversed := func(keys []string) []string {
+		out := make([]string, len(keys))
+		for i, key := range keys {
+			out[len(keys)-1-i] = key
+		}
+		return out
+	}
+	check := func(name string, got []string, want []string) {
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+
+	keys, pages := scanAll(ydbserverrpc.ScanArgs{Prefix: "row", Limit: 7})
+	check("prefix", keys, want)
+	if pages != 7 {
+		t.Errorf("Scanned %d pages, want 7.", pages)
+	}
+	keys, _ = scanAll(ydbserverrpc.ScanArgs{Prefix: "row", Limit: 7, Reverse: true})
+	check("reverse prefix", keys, reversed(want))
+	keys, _ = scanAll(ydbserverrpc.ScanArgs{StartRowKey: "row05", EndRowKey: "row15", Limit: 3})
+	check("range", keys, want[5:15])
+	keys, _ = scanAll(ydbserverrpc.ScanArgs{StartRowKey: "row05", EndRowKey: "row15", Limit: 3, Reverse: true})
+	check("reverse range", keys, reversed(want[5:15]))
+	keys, _ = scanAll(ydbserverrpc.ScanArgs{})
+	check("all", keys, append(append([]string{"a"}, want...), "z"))
+	keys, pages = scanAll(ydbserverrpc.ScanArgs{Prefix: "row4", ByteLimit: 1, Reverse: true})
+	check("byte limit", keys, reversed(want[38:]))
+	if pages != len(keys) {
+		t.Errorf("Scanned %d pages of one row for %d rows.", pages, len(keys))
+	}
+
+	// Reverse scans cross the data blocks of a segment
+	big := make([]string, 0)
+	for i := 0; i < 1000; i++ {
+		rowKey := fmt.Sprintf("big%04d", i)
+		putRow(t, client, rowKey, map[string]string{"Name:First Name": rowKey})
+		big = append(big, rowKey)
+	}
+	table.dataLocker.Lock()
+	err := table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = scanAll(ydbserverrpc.ScanArgs{StartRowKey: "big0100", EndRowKey: "big0899x", Limit: 150, Reverse: true})
+	check("reverse blocks", keys, reversed(big[100:900]))
+
+	// Bad arguments
+	for _, args := range []ydbserverrpc.ScanArgs{{Limit: -1}, {ByteLimit: -1}, {ContinuationToken: "??"}} {
+		args.TableName = tableName
+		var reply ydbserverrpc.ScanReply
+		if err := client.Call("YDBServer.Scan", &args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != ydbserverrpc.InvalidArgument {
+			t.Errorf("Scan %+v got status %d.", args, reply.Status)
+		}
+	}
+}
+
+func TestYdbServer_Scanner(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+	flush := func() {
+		table.dataLocker.Lock()
+		err := table.flush(testServer)
+		table.dataLocker.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		rowKey := fmt.Sprintf("s%02d", i)
+		putRow(t, client, rowKey, map[string]string{"Name:First Name": rowKey})
+		if i == 14 {
+			flush()
+		}
+	}
+
+	openScanner := func(args ydbserverrpc.OpenScannerArgs) uint64 {
+		args.TableName = tableName
+		var reply ydbserverrpc.OpenScannerReply
+		if err := client.Call("YDBServer.OpenScanner", &args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != ydbserverrpc.OK {
+			t.Fatalf("OpenScanner failed with status %d.", reply.Status)
+		}
+		return reply.ScannerID
+	}
+	next := func(id uint64, limit int) ydbserverrpc.ScannerNextReply {
+		var reply ydbserverrpc.ScannerNextReply
+		if err := client.Call("YDBServer.ScannerNext", &ydbserverrpc.ScannerNextArgs{ScannerID: id, Limit: limit}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	checkPage := func(reply ydbserverrpc.ScannerNextReply, from int, to int) {
+		if reply.Status != ydbserverrpc.OK || len(reply.Rows) != to-from {
+			t.Fatalf("Got page %+v, want rows %d to %d.", reply, from, to)
+		}
+		for i, row := range reply.Rows {
+			rowKey := fmt.Sprintf("s%02d", from+i)
+			value := make(map[string]string)
+			json.Unmarshal([]byte(row.Row), &value)
+			if row.RowKey != rowKey || value["Name:First Name"] != rowKey {
+				t.Errorf("Got row %s %v, want %s.", row.RowKey, value, rowKey)
+			}
+		}
+	}
+
+	// Writes, flushes and compactions after the open are not seen
+	id := openScanner(ydbserverrpc.OpenScannerArgs{Prefix: "s"})
+	checkPage(next(id, 10), 0, 10)
+	inputs := table.snapshotSegments()
+	putRow(t, client, "s12", map[string]string{"Name:First Name": "changed"})
+	putRow(t, client, "s50", map[string]string{"Name:First Name": "s50"})
+	var deleteRowReply ydbserverrpc.DeleteRowReply
+	if err := client.Call("YDBServer.DeleteRow", &ydbserverrpc.DeleteRowArgs{TableName: tableName, RowKey: "s20"}, &deleteRowReply); err != nil {
+		t.Fatal(err)
+	}
+	flush()
+	compactAll(t, table)
+	checkPage(next(id, 10), 10, 20)
+	if _, err := os.Stat(inputs[0].path); err != nil {
+		t.Errorf("Segment held by a scanner deleted: %v", err)
+	}
+	reply := next(id, 20)
+	checkPage(reply, 20, 30)
+	if !reply.Done {
+		t.Error("Last page not done.")
+	}
+	if _, err := os.Stat(inputs[0].path); !os.IsNotExist(err) {
+		t.Error("Segment not deleted after the scanner closed.")
+	}
+	if reply := next(id, 10); reply.Status != ydbserverrpc.ScannerNotFound {
+		t.Errorf("Done scanner still open: %+v", reply)
+	}
+
+	// Closed, expired and table scanners go away
+	id = openScanner(ydbserverrpc.OpenScannerArgs{Prefix: "s", Reverse: true})
+	if reply := next(id, 1); len(reply.Rows) != 1 || reply.Rows[0].RowKey != "s50" {
+		t.Errorf("Wrong reverse page %+v", reply)
+	}
+	var closeReply ydbserverrpc.CloseScannerReply
+	if err := client.Call("YDBServer.CloseScanner", &ydbserverrpc.CloseScannerArgs{ScannerID: id}, &closeReply); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("YDBServer.CloseScanner", &ydbserverrpc.CloseScannerArgs{ScannerID: id}, &closeReply); err != nil {
+		t.Fatal(err)
+	}
+	if closeReply.Status != ydbserverrpc.ScannerNotFound {
+		t.Errorf("Closed scanner closed again with status %d.", closeReply.Status)
+	}
+	id = openScanner(ydbserverrpc.OpenScannerArgs{Lease: 50 * time.Millisecond})
+	time.Sleep(200 * time.Millisecond)
+	if reply := next(id, 10); reply.Status != ydbserverrpc.ScannerNotFound {
+		t.Errorf("Expired scanner still open: %+v", reply)
+	}
+	// A call holding the scanner while its lease runs out cannot renew it
+	id = openScanner(ydbserverrpc.OpenScannerArgs{})
+	testServer.scannersLocker.Lock()
+	sc := testServer.scanners[id]
+	testServer.scannersLocker.Unlock()
+	sc.locker.Lock()
+	sc.timer.Reset(time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	renewed := sc.renew()
+	sc.locker.Unlock()
+	if renewed {
+		t.Error("Lease renewed after it ran out.")
+	}
+	if reply := next(id, 10); reply.Status != ydbserverrpc.ScannerNotFound {
+		t.Errorf("Expired scanner still open: %+v", reply)
+	}
+	id = openScanner(ydbserverrpc.OpenScannerArgs{})
+	reopenTable(t, client, tableName)
+	if reply := next(id, 10); reply.Status != ydbserverrpc.ScannerNotFound {
+		t.Errorf("Scanner of a closed table still open: %+v", reply)
+	}
+	testServer.scannersLocker.Lock()
+	if n := len(testServer.scanners); n != 0 {
+		t.Errorf("%d scanners left open.", n)
+	}
+	testServer.scannersLocker.Unlock()
+}
+
+func TestYdbServer_Filters(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	for i := 1; i <= 10; i++ {
+		city := "Pittsburgh"
+		if i%2 == 1 {
+			city = "Boston"
+		}
+		putRow(t, client, fmt.Sprintf("user%02d", i), map[string]string{
+			"Name:First Name": fmt.Sprintf("First%02d", i),
+			"Name:Last Name":  "Last",
+			"Address:City":    city,
+		})
+	}
+	putRow(t, client, "other", map[string]string{"Address:City": "Boston"})
+
+	// Returns the row keys, with the columns of the first row, of GetRows
+	getRows := func(filter ydbserverrpc.Filter) ([]string, []string) {
+		args := &ydbserverrpc.GetRowsArgs{TableName: tableName, StartRowKey: "a", EndRowKey: "z", Filter: &filter}
+		var reply ydbserverrpc.GetRowsReply
+		if err := client.Call("YDBServer.GetRows", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != ydbserverrpc.OK {
+			t.Fatalf("GetRows with filter %+v failed with status %d.", filter, reply.Status)
+		}
+		keys := make([]string, 0)
+		for key := range reply.Rows {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		columns := make([]string, 0)
+		if len(keys) > 0 {
+			row := make(map[string]string)
+			json.Unmarshal([]byte(reply.Rows[keys[0]]), &row)
+			for column := range row {
+				columns = append(columns, column)
+			}
+			sort.Strings(columns)
+		}
+		return keys, columns
+	}
+	users := func(ids ...int) string {
+		keys := make([]string, 0)
+		for _, id := range ids {
+			keys = append(keys, fmt.Sprintf("user%02d", id))
+		}
+		return strings.Join(keys, ",")
+	}
+	boston := ydbserverrpc.Filter{Type: ydbserverrpc.FilterColumnValue, Column: "Address:City", Op: ydbserverrpc.Equal, Value: "Boston"}
+	for _, c := range []struct {
+		name    string
+		filter  ydbserverrpc.Filter
+		keys    string
+		columns string
+	}{
+		{"row prefix", ydbserverrpc.Filter{Type: ydbserverrpc.FilterRowPrefix, Value: "user0"}, users(1, 2, 3, 4, 5, 6, 7, 8, 9), "Address:City,Name:First Name,Name:Last Name"},
+		{"row regex", ydbserverrpc.Filter{Type: ydbserverrpc.FilterRowRegex, Value: "^user(02|05)$"}, users(2, 5), "Address:City,Name:First Name,Name:Last Name"},
+		{"column value", boston, "other," + users(1, 3, 5, 7, 9), "Address:City"},
+		{"greater or equal", ydbserverrpc.Filter{Type: ydbserverrpc.FilterColumnValue, Column: "Name:First Name", Op: ydbserverrpc.GreaterOrEqual, Value: "First08"}, users(8, 9, 10), "Address:City,Name:First Name,Name:Last Name"},
+		{"qualifier prefix", ydbserverrpc.Filter{Type: ydbserverrpc.FilterQualifierPrefix, Value: "First"}, users(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), "Name:First Name"},
+		{"family", ydbserverrpc.Filter{Type: ydbserverrpc.FilterFamily, Value: "Name"}, users(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), "Name:First Name,Name:Last Name"},
+		{"first key", ydbserverrpc.Filter{Type: ydbserverrpc.FilterFirstKeyOnly}, "other," + users(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), "Address:City"},
+		{"page", ydbserverrpc.Filter{Type: ydbserverrpc.FilterPage, Limit: 3}, "other," + users(1, 2), "Address:City"},
+		{"and", ydbserverrpc.Filter{Type: ydbserverrpc.FilterAnd, Filters: []ydbserverrpc.Filter{
+			boston,
+			{Type: ydbserverrpc.FilterFamily, Value: "Name"},
+		}}, users(1, 3, 5, 7, 9), "Name:First Name,Name:Last Name"},
+		{"or", ydbserverrpc.Filter{Type: ydbserverrpc.FilterOr, Filters: []ydbserverrpc.Filter{
+			{Type: ydbserverrpc.FilterRowRegex, Value: "01$"},
+			{Type: ydbserverrpc.FilterRowPrefix, Value: "user1"},
+		}}, users(1, 10), "Address:City,Name:First Name,Name:Last Name"},
+	} {
+		keys, columns := getRows(c.filter)
+		if strings.Join(keys, ",") != c.keys || strings.Join(columns, ",") != c.columns {
+			t.Errorf("%s: got rows %v with columns %v, want %s with %s", c.name, keys, columns, c.keys, c.columns)
+		}
+	}
+
+	// A page filter counts rows across the pages of a scanner
+	var openReply ydbserverrpc.OpenScannerReply
+	openArgs := &ydbserverrpc.OpenScannerArgs{TableName: tableName, Prefix: "user", Filter: &ydbserverrpc.Filter{
+		Type: ydbserverrpc.FilterAnd,
+		Filters: []ydbserverrpc.Filter{
+			{Type: ydbserverrpc.FilterColumnValue, Column: "Address:City", Op: ydbserverrpc.NotEqual, Value: "Boston"},
+			{Type: ydbserverrpc.FilterPage, Limit: 3},
+		},
+	}}
+	if err := client.Call("YDBServer.OpenScanner", openArgs, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	scanned := make([]string, 0)
+	for done := false; !done; {
+		var reply ydbserverrpc.ScannerNextReply
+		if err := client.Call("YDBServer.ScannerNext", &ydbserverrpc.ScannerNextArgs{ScannerID: openReply.ScannerID, Limit: 1}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range reply.Rows {
+			scanned = append(scanned, row.RowKey)
+		}
+		done = reply.Done || reply.Status != ydbserverrpc.OK
+	}
+	if strings.Join(scanned, ",") != users(2, 4, 6) {
+		t.Errorf("Scanner with page filter returned %v", scanned)
+	}
+
+	// and across the pages of Scan, cut by rows or by bytes
+	for _, args := range []ydbserverrpc.ScanArgs{{Limit: 3}, {ByteLimit: 1}} {
+		args.TableName, args.Prefix = tableName, "user"
+		args.Filter = &ydbserverrpc.Filter{Type: ydbserverrpc.FilterPage, Limit: 5}
+		scanned := make([]string, 0)
+		for done := false; !done; {
+			var reply ydbserverrpc.ScanReply
+			if err := client.Call("YDBServer.Scan", &args, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply.Status != ydbserverrpc.OK {
+				t.Fatalf("Scan with page filter failed with status %d.", reply.Status)
+			}
+			for _, row := range reply.Rows {
+				scanned = append(scanned, row.RowKey)
+			}
+			args.ContinuationToken, done = reply.ContinuationToken, reply.Done
+		}
+		if strings.Join(scanned, ",") != users(1, 2, 3, 4, 5) {
+			t.Errorf("Scan pages of %d rows and %d bytes with page filter returned %v", args.Limit, args.ByteLimit, scanned)
+		}
+	}
+
+	// Broken filters are rejected
+	for _, filter := range []ydbserverrpc.Filter{
+		{Type: ydbserverrpc.FilterRowRegex, Value: "("},
+		{Type: 100},
+		{Type: ydbserverrpc.FilterColumnValue, Value: "Boston"},
+		{Type: ydbserverrpc.FilterOr, Filters: []ydbserverrpc.Filter{{Type: ydbserverrpc.FilterPage, Limit: -1}}},
+	} {
+		var reply ydbserverrpc.ScanReply
+		if err := client.Call("YDBServer.Scan", &ydbserverrpc.ScanArgs{TableName: tableName, Filter: &filter}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != ydbserverrpc.InvalidArgument {
+			t.Errorf("Filter %+v got status %d.", filter, reply.Status)
+		}
+	}
+}
+
+func TestYdbServer_ColumnProjection(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+
+	// Columns of the rows spread over a segment and the memtable
+	putRow(t, client, "p1", map[string]string{"Name:First Name": "First1", "Name:Last Name": "Last1"})
+	putRow(t, client, "p2", map[string]string{"Name:First Name": "First2"})
+	table.dataLocker.Lock()
+	err := table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRow(t, client, "p1", map[string]string{"Address:City": "Pittsburgh", "Address:Zip": "15213"})
+	putRow(t, client, "p3", map[string]string{"Address:City": "Boston"})
+
+	columnsOf := func(row string) string {
+		values := make(map[string]string)
+		if err := json.Unmarshal([]byte(row), &values); err != nil {
+			t.Fatal(err)
+		}
+		columns := make([]string, 0)
+		for column := range values {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		return strings.Join(columns, ",")
+	}
+	for _, c := range []struct {
+		columns []string
+		want    string
+	}{
+		{nil, "Address:City,Address:Zip,Name:First Name,Name:Last Name"},
+		{[]string{"Name"}, "Name:First Name,Name:Last Name"},
+		{[]string{"Address:City", "Name:Last Name"}, "Address:City,Name:Last Name"},
+		{[]string{"Address", "Name:First Name"}, "Address:City,Address:Zip,Name:First Name"},
+		{[]string{"Other"}, ""},
+	} {
+		var reply ydbserverrpc.GetRowReply
+		args := &ydbserverrpc.GetRowArgs{TableName: tableName, RowKey: "p1", Columns: c.columns}
+		if err := client.Call("YDBServer.GetRow", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got := columnsOf(reply.Row); reply.Status != ydbserverrpc.OK || got != c.want {
+			t.Errorf("GetRow with columns %v got %d %s, want %s", c.columns, reply.Status, got, c.want)
+		}
+	}
+
+	// Rows without a selected column are left out of ranges
+	var rowsReply ydbserverrpc.GetRowsReply
+	rowsArgs := &ydbserverrpc.GetRowsArgs{TableName: tableName, StartRowKey: "p", EndRowKey: "q", Columns: []string{"Name:First Name"}}
+	if err := client.Call("YDBServer.GetRows", rowsArgs, &rowsReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(rowsReply.Rows) != 2 || columnsOf(rowsReply.Rows["p1"]) != "Name:First Name" || columnsOf(rowsReply.Rows["p2"]) != "Name:First Name" {
+		t.Errorf("GetRows with columns returned %v", rowsReply.Rows)
+	}
+	var scanReply ydbserverrpc.ScanReply
+	scanArgs := &ydbserverrpc.ScanArgs{TableName: tableName, Prefix: "p", Columns: []string{"Address"}}
+	if err := client.Call("YDBServer.Scan", scanArgs, &scanReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(scanReply.Rows) != 2 || scanReply.Rows[0].RowKey != "p1" || columnsOf(scanReply.Rows[0].Row) != "Address:City,Address:Zip" || scanReply.Rows[1].RowKey != "p3" {
+		t.Errorf("Scan with columns returned %v", scanReply.Rows)
+	}
+
+	// Scanners copy only the selected columns of the memtable
+	var openReply ydbserverrpc.OpenScannerReply
+	openArgs := &ydbserverrpc.OpenScannerArgs{TableName: tableName, Prefix: "p", Columns: []string{"Address:Zip"}}
+	if err := client.Call("YDBServer.OpenScanner", openArgs, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	testServer.scannersLocker.Lock()
+	sc := testServer.scanners[openReply.ScannerID]
+	testServer.scannersLocker.Unlock()
+	children := sc.it.(*mergeIterator).children
+	if row, ok := children[len(children)-1].(*memTableIterator).table.get("p1"); !ok || len(row.Columns) != 1 {
+		t.Errorf("Scanner copied %v of the memtable", row.Columns)
+	}
+	var nextReply ydbserverrpc.ScannerNextReply
+	if err := client.Call("YDBServer.ScannerNext", &ydbserverrpc.ScannerNextArgs{ScannerID: openReply.ScannerID}, &nextReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(nextReply.Rows) != 1 || columnsOf(nextReply.Rows[0].Row) != "Address:Zip" {
+		t.Errorf("Scanner with columns returned %v", nextReply.Rows)
+	}
+
+	// Empty families and qualifiers are rejected
+	for _, columns := range [][]string{{""}, {"Name:"}, {":First Name"}} {
+		var reply ydbserverrpc.GetRowReply
+		args := &ydbserverrpc.GetRowArgs{TableName: tableName, RowKey: "p1", Columns: columns}
+		if err := client.Call("YDBServer.GetRow", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != ydbserverrpc.InvalidArgument {
+			t.Errorf("GetRow with columns %q got status %d.", columns, reply.Status)
+		}
+	}
+}
+
+func TestYdbServer_ReplyCells(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+	table.dataLocker.Lock()
+	table.metadata.FamilyOptions = map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {MaxVersions: 2}}
+	table.dataLocker.Unlock()
+	for _, ts := range []int64{10, 20} {
+		putRowAt(t, client, "c1", map[string]string{
+			"Name:First Name": "First" + strconv.FormatInt(ts, 10),
+			"Address:City":    "City" + strconv.FormatInt(ts, 10),
+		}, ts)
+	}
+	putRowAt(t, client, "c2", map[string]string{"Name:Last Name": "Last"}, 30)
+
+	format := func(cells []ydbserverrpc.Cell) string {
+		formatted := make([]string, 0)
+		for _, cell := range cells {
+			formatted = append(formatted, fmt.Sprintf("%s/%s/%s/%d", cell.Family, cell.Qualifier, cell.Value, cell.Timestamp))
+		}
+		return strings.Join(formatted, ",")
+	}
+	for _, c := range []struct {
+		maxVersions int
+		want        string
+	}{
+		{0, "Address/City/City20/20,Name/First Name/First20/20"},
+		{2, "Address/City/City20/20,Name/First Name/First20/20,Name/First Name/First10/10"},
+	} {
+		var reply ydbserverrpc.GetRowReply
+		args := &ydbserverrpc.GetRowArgs{TableName: tableName, RowKey: "c1", MaxVersions: c.maxVersions}
+		if err := client.Call("YDBServer.GetRow", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if got := format(reply.Cells); got != c.want {
+			t.Errorf("GetRow with %d versions got cells %s, want %s", c.maxVersions, got, c.want)
+		}
+		// The JSON form is still filled in for older clients
+		if row := getRow(t, client, "c1"); row["Name:First Name"] != "First20" {
+			t.Errorf("GetRow got row %v", row)
+		}
+	}
+
+	var rowsReply ydbserverrpc.GetRowsReply
+	rowsArgs := &ydbserverrpc.GetRowsArgs{TableName: tableName, StartRowKey: "c", EndRowKey: "d"}
+	if err := client.Call("YDBServer.GetRows", rowsArgs, &rowsReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(rowsReply.Cells) != 2 || format(rowsReply.Cells["c2"]) != "Name/Last Name/Last/30" || len(rowsReply.Rows) != 2 {
+		t.Errorf("GetRows got cells %v", rowsReply.Cells)
+	}
+	var scanReply ydbserverrpc.ScanReply
+	scanArgs := &ydbserverrpc.ScanArgs{TableName: tableName, Prefix: "c", Columns: []string{"Address"}}
+	if err := client.Call("YDBServer.Scan", scanArgs, &scanReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(scanReply.Rows) != 1 || format(scanReply.Rows[0].Cells) != "Address/City/City20/20" {
+		t.Errorf("Scan got rows %v", scanReply.Rows)
+	}
+}
+
+func TestYdbServer_BinaryData(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+
+	value := make([]byte, 256)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	rowKeys := []string{"bin\xff\xfe", "bin|x", "bin\x00a", "bin\nnext", "bin\xc3\x28", "bina"}
+	qualifier := "Name:\xff|\x00q"
+	for i, rowKey := range rowKeys {
+		putRowArgs := &ydbserverrpc.PutRowArgs{
+			TableName:      tableName,
+			RowKey:         rowKey,
+			UpdatedColumns: map[string][]byte{qualifier: append([]byte{byte(i)}, value...)},
+		}
+		var putRowReply ydbserverrpc.PutRowReply
+		if err := client.Call("YDBServer.PutRow", putRowArgs, &putRowReply); err != nil {
+			t.Fatal(err)
+		}
+		if putRowReply.Status != ydbserverrpc.OK {
+			t.Fatalf("PutRow of %q failed with status %d.", rowKey, putRowReply.Status)
+		}
+	}
+	sorted := append([]string(nil), rowKeys...)
+	sort.Strings(sorted)
+
+	check := func(stage string) {
+		for i, rowKey := range rowKeys {
+			want := append([]byte{byte(i)}, value...)
+			var reply ydbserverrpc.GetColumnByRowReply
+			args := &ydbserverrpc.GetColumnByRowArgs{TableName: tableName, RowKey: rowKey, QualifiedColumnKey: qualifier}
+			if err := client.Call("YDBServer.GetColumnByRow", args, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reply.Value, want) {
+				t.Errorf("%s: value of %q is %q", stage, rowKey, reply.Value)
+			}
+		}
+		var scanReply ydbserverrpc.ScanReply
+		if err := client.Call("YDBServer.Scan", &ydbserverrpc.ScanArgs{TableName: tableName, Prefix: "bin", Columns: []string{qualifier}}, &scanReply); err != nil {
+			t.Fatal(err)
+		}
+		scanned := make([]string, 0)
+		for _, row := range scanReply.Rows {
+			scanned = append(scanned, row.RowKey)
+			if len(row.Cells) != 1 || row.Cells[0].Qualifier != "\xff|\x00q" || len(row.Cells[0].Value) != 257 {
+				t.Errorf("%s: scanned cells of %q are %v", stage, row.RowKey, row.Cells)
+			}
+		}
+		if strings.Join(scanned, ",") != strings.Join(sorted, ",") {
+			t.Errorf("%s: scanned %q, want %q", stage, scanned, sorted)
+		}
+	}
+	check("memtable")
+	reopenTable(t, client, tableName)
+	check("recovered")
+	table := testServer.tables[tableName]
+	for _, rowKey := range rowKeys[:3] {
+		putRow(t, client, rowKey, map[string]string{"Name:Other": "other"})
+		table.dataLocker.Lock()
+		err := table.flush(testServer)
+		table.dataLocker.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("segments")
+	compactAll(t, table)
+	check("compacted")
+	reopenTable(t, client, tableName)
+	check("reopened")
+
+	// Binary key bounds survive the manifest
+	meta := segmentMeta{ID: 1, MinKey: "\x00\xff", MaxKey: "\xff\xc3"}
+	var decoded segmentMeta
+	if v, err := json.Marshal(meta); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(v, &decoded); err != nil || decoded != meta {
+		t.Errorf("Segment meta %+v came back as %+v", meta, decoded)
+	}
+
+	var putRowReply ydbserverrpc.PutRowReply
+	if err := client.Call("YDBServer.PutRow", &ydbserverrpc.PutRowArgs{TableName: tableName, UpdatedColumns: map[string][]byte{qualifier: value}}, &putRowReply); err != nil {
+		t.Fatal(err)
+	}
+	if putRowReply.Status != ydbserverrpc.InvalidArgument {
+		t.Errorf("PutRow with an empty row key got status %d.", putRowReply.Status)
+	}
+}
+
+func TestYdbServer_GetColumnByRow(t *testing.T) {
+	client := serverStartup()
+	putRowRecords(client, N)
+
+	start := time.Now()
+	getColumnByRowRecords(client, N)
+	end := time.Now()
+	diff := end.Sub(start)
+
+	fmt.Printf("Test GetColumnByRow for %d times, take %v.\n", N, diff)
+
+	serverCloseAndCleanup(client)
+}
+
+func TestYdbServer_Flush_Segments(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+
+	// Rows of the line based data file of the first format move into
+	// segments, older than any row written later
+	var closeTableReply ydbserverrpc.CloseTableReply
+	if err := client.Call("YDBServer.CloseTable", &ydbserverrpc.CloseTableArgs{TableName: tableName}, &closeTableReply); err != nil {
+		t.Fatal(err)
+	}
+	_, tableDataFilename := formatFilename(tableName)
+	data := `row123|{"Columns":{"Name:First Name":"Old"}}` + "\n" +
+		`row900|{"Columns":{"Name:First Name":"Old"}}` + "\n" +
+		`row900|{"Columns":{"Name:First Name":"New","Name:Last Name":"Last"}}` + "\n"
+	if err := os.WriteFile(tableDataFilename, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var openReply ydbserverrpc.OpenTableReply
+	if err := client.Call("YDBServer.OpenTable", &ydbserverrpc.OpenTableArgs{TableName: tableName}, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	if row := getRow(t, client, "row900"); row["Name:First Name"] != "New" || row["Name:Last Name"] != "Last" {
+		t.Errorf("Wrong row of the old data file: %v", row)
+	}
+	if _, err := os.Stat(tableDataFilename); !os.IsNotExist(err) {
+		t.Error("Old data file was not removed.")
+	}
+
+	setMemTableLimit(tableName, 50*testRowBytes)
+
+	// Every round overwrites the last name, so each row ends up in several
+	// segments
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			putRow(t, client, fmt.Sprintf("row%03d", i), map[string]string{
+				"Name:First Name": "First" + strconv.Itoa(i),
+				"Name:Last Name":  "Last" + strconv.Itoa(round),
+			})
+		}
+	}
+	if flushes := testServer.tables[tableName].nextSegmentID; flushes < 2 {
+		t.Fatalf("Expected several flushes, got %d.", flushes)
+	}
+
+	checkRows := func() {
+		row := getRow(t, client, "row123")
+		if row["Name:First Name"] != "First123" || row["Name:Last Name"] != "Last2" {
+			t.Errorf("Wrong row: %v", row)
+		}
+		if row := getRow(t, client, "row_not_exist"); len(row) != 0 {
+			t.Errorf("Expected empty row, got %v", row)
+		}
+
+		getRowsArgs := &ydbserverrpc.GetRowsArgs{
+			TableName:   tableName,
+			StartRowKey: "row010",
+			EndRowKey:   "row019",
+		}
+		var getRowsReply ydbserverrpc.GetRowsReply
+		if err := client.Call("YDBServer.GetRows", getRowsArgs, &getRowsReply); err != nil {
+			t.Fatal(err)
+		}
+		if len(getRowsReply.Rows) != 10 {
+			t.Errorf("Expected 10 rows, got %d.", len(getRowsReply.Rows))
+		}
+	}
+	checkRows()
+
+	// Segments are found again after reopening the table
+	reopenTable(t, client, tableName)
+	checkRows()
+
+}
+
+func TestYdbServer_Compression(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+
+	// One segment per codec, the codec is picked by the family options
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20)
+	codecs := []ydbserverrpc.Compression{ydbserverrpc.CompressionNone, ydbserverrpc.CompressionFlate, ydbserverrpc.CompressionGzip, ydbserverrpc.CompressionZlib}
+	sizes := make([]int64, len(codecs))
+	for i, c := range codecs {
+		table.dataLocker.Lock()
+		table.metadata.FamilyOptions = map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {Compression: c}}
+		table.dataLocker.Unlock()
+		for j := 0; j < 100; j++ {
+			putRow(t, client, fmt.Sprintf("z%d-%03d", i, j), map[string]string{"Name:First Name": text + strconv.Itoa(j)})
+		}
+		table.dataLocker.Lock()
+		err := table.flush(testServer)
+		table.dataLocker.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments := table.snapshotSegments()
+		sizes[i] = segments[len(segments)-1].meta.Size
+	}
+	for i := 1; i < len(codecs); i++ {
+		if sizes[i]*4 > sizes[0] {
+			t.Errorf("Segment with codec %d takes %d bytes, %d uncompressed", codecs[i], sizes[i], sizes[0])
+		}
+	}
+
+	check := func(stage string) {
+		for i := range codecs {
+			for _, j := range []int{0, 57, 99} {
+				rowKey := fmt.Sprintf("z%d-%03d", i, j)
+				if row := getRow(t, client, rowKey); row["Name:First Name"] != text+strconv.Itoa(j) {
+					t.Fatalf("%s: wrong row %s %v", stage, rowKey, row)
+				}
+			}
+		}
+		var scanReply ydbserverrpc.ScanReply
+		if err := client.Call("YDBServer.Scan", &ydbserverrpc.ScanArgs{TableName: tableName, Prefix: "z", Reverse: true}, &scanReply); err != nil {
+			t.Fatal(err)
+		}
+		if len(scanReply.Rows) != 100*len(codecs) || scanReply.Rows[0].RowKey != "z3-099" {
+			t.Errorf("%s: scanned %d rows", stage, len(scanReply.Rows))
+		}
+	}
+	check("segments")
+	compactAll(t, table)
+	check("compacted")
+	// The codec is recorded in the blocks, so files stay readable whatever
+	// the options are now
+	reopenTable(t, client, tableName)
+	check("reopened")
+
+	// Blocks that do not shrink are stored as they are
+	noise := make([]byte, 1000)
+	rand.Read(noise)
+	if data, err := compressBlock(ydbserverrpc.CompressionGzip, noise); err != nil || data[0] != byte(ydbserverrpc.CompressionNone) {
+		t.Errorf("Incompressible block stored with codec %d", data[0])
+	}
+	if _, err := decompressBlock([]byte{byte(ydbserverrpc.CompressionZlib), 1, 2, 3}); err == nil {
+		t.Error("Corrupt block decompressed")
+	}
+	if _, err := decompressBlock([]byte{100}); err == nil {
+		t.Error("Block with an unknown codec decompressed")
+	}
+
+	var createTableReply ydbserverrpc.CreateTableReply
+	createTableArgs := &ydbserverrpc.CreateTableArgs{
+		TableName:      "compressedTable",
+		ColumnFamilies: []string{"Name"},
+		FamilyOptions:  map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {Compression: 100}},
+	}
+	if err := client.Call("YDBServer.CreateTable", createTableArgs, &createTableReply); err != nil {
+		t.Fatal(err)
+	}
+	if createTableReply.Status != ydbserverrpc.InvalidArgument {
+		t.Errorf("CreateTable with an unknown codec got status %d.", createTableReply.Status)
+	}
+}
+
+func TestYdbServer_LocalityGroups(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+
+	for i := 0; i < 20; i++ {
+		putRow(t, client, fmt.Sprintf("g%02d", i), map[string]string{"Name:First Name": "First" + strconv.Itoa(i), "Address:City": "City" + strconv.Itoa(i)})
+	}
+	flush := func() {
+		table.dataLocker.Lock()
+		err := table.flush(testServer)
+		table.dataLocker.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush()
+
+	// Every family is flushed into a file of its own
+	familySegments := func() map[string][]*segment {
+		families := make(map[string][]*segment)
+		for _, seg := range table.snapshotSegments() {
+			families[seg.meta.Family] = append(families[seg.meta.Family], seg)
+		}
+		return families
+	}
+	families := familySegments()
+	if len(families) != 2 || len(families["Name"]) != 1 || len(families["Address"]) != 1 {
+		t.Fatalf("Flush wrote segments %v", families)
+	}
+	for family, segments := range families {
+		it := segments[0].iterator()
+		for it.seek(""); it.valid(); it.next() {
+			row, _ := it.row()
+			for key := range row.Columns {
+				if columnFamily(key) != family {
+					t.Fatalf("Segment of %s holds %s", family, key)
+				}
+			}
+		}
+	}
+
+	// Projected reads leave the files of other families alone
+	address := families["Address"][0]
+	cached := func() int {
+		testServer.blockCache.locker.Lock()
+		defer testServer.blockCache.locker.Unlock()
+		return len(testServer.blockCache.files[address.path])
+	}
+	before := cached()
+	var rowReply ydbserverrpc.GetRowReply
+	if err := client.Call("YDBServer.GetRow", &ydbserverrpc.GetRowArgs{TableName: tableName, RowKey: "g07", Columns: []string{"Name"}}, &rowReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(rowReply.Cells) != 1 || string(rowReply.Cells[0].Value) != "First7" {
+		t.Errorf("Projected GetRow returned %v", rowReply.Cells)
+	}
+	var scanReply ydbserverrpc.ScanReply
+	if err := client.Call("YDBServer.Scan", &ydbserverrpc.ScanArgs{TableName: tableName, Prefix: "g", Columns: []string{"Name:First Name"}}, &scanReply); err != nil {
+		t.Fatal(err)
+	}
+	if len(scanReply.Rows) != 20 {
+		t.Errorf("Projected scan returned %d rows", len(scanReply.Rows))
+	}
+	if after := cached(); after != before {
+		t.Errorf("Projected reads cached %d blocks of the Address segment", after-before)
+	}
+	var openReply ydbserverrpc.OpenScannerReply
+	if err := client.Call("YDBServer.OpenScanner", &ydbserverrpc.OpenScannerArgs{TableName: tableName, Columns: []string{"Name"}}, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	testServer.scannersLocker.Lock()
+	sc := testServer.scanners[openReply.ScannerID]
+	testServer.scannersLocker.Unlock()
+	if len(sc.segments) != 1 || sc.segments[0].meta.Family != "Name" {
+		t.Errorf("Projected scanner holds %d segments", len(sc.segments))
+	}
+	testServer.closeScanner(openReply.ScannerID)
+
+	// A row delete reaches every family
+	var deleteReply ydbserverrpc.DeleteRowReply
+	if err := client.Call("YDBServer.DeleteRow", &ydbserverrpc.DeleteRowArgs{TableName: tableName, RowKey: "g03"}, &deleteReply); err != nil {
+		t.Fatal(err)
+	}
+	flush()
+	check := func(stage string) {
+		for _, family := range []string{"Name", "Address"} {
+			var reply ydbserverrpc.GetRowReply
+			if err := client.Call("YDBServer.GetRow", &ydbserverrpc.GetRowArgs{TableName: tableName, RowKey: "g03", Columns: []string{family}}, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if len(reply.Cells) != 0 {
+				t.Errorf("%s: deleted row has %v in %s", stage, reply.Cells, family)
+			}
+		}
+		if row := getRow(t, client, "g11"); row["Name:First Name"] != "First11" || row["Address:City"] != "City11" {
+			t.Errorf("%s: wrong row %v", stage, row)
+		}
+	}
+	check("flushed")
+
+	// Compaction merges the segments of every family apart
+	compactAll(t, table)
+	families = familySegments()
+	if len(families) != 2 || len(families["Name"]) != 1 || len(families["Address"]) != 1 {
+		t.Errorf("Compaction left segments %v", families)
+	}
+	check("compacted")
+	reopenTable(t, client, tableName)
+	table = testServer.tables[tableName]
+	if families = familySegments(); families["Name"][0].meta.Family != "Name" || families["Address"][0].meta.Family != "Address" {
+		t.Errorf("Reopened segments %v", families)
+	}
+	check("reopened")
+}
+
+func TestYdbServer_AlterTable(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+
+	// Writes to families the table does not declare are refused
+	for _, column := range []string{"Phone:Home", "Phone", ":Home"} {
+		var reply ydbserverrpc.PutRowReply
+		args := &ydbserverrpc.PutRowArgs{TableName: tableName, RowKey: "a", UpdatedColumns: map[string][]byte{column: []byte("1")}}
+		if err := client.Call("YDBServer.PutRow", args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != ydbserverrpc.UnknownFamily {
+			t.Errorf("PutRow of %s got status %d.", column, reply.Status)
+		}
+	}
+	var deleteColumnsReply ydbserverrpc.DeleteColumnsReply
+	if err := client.Call("YDBServer.DeleteColumns", &ydbserverrpc.DeleteColumnsArgs{TableName: tableName, RowKey: "a", QualifiedColumnKeys: []string{"Phone:Home"}}, &deleteColumnsReply); err != nil {
+		t.Fatal(err)
+	}
+	var deleteFamilyReply ydbserverrpc.DeleteFamilyReply
+	if err := client.Call("YDBServer.DeleteFamily", &ydbserverrpc.DeleteFamilyArgs{TableName: tableName, RowKey: "a", Family: "Phone"}, &deleteFamilyReply); err != nil {
+		t.Fatal(err)
+	}
+	if deleteColumnsReply.Status != ydbserverrpc.UnknownFamily || deleteFamilyReply.Status != ydbserverrpc.UnknownFamily {
+		t.Errorf("Deletes in an unknown family got status %d and %d.", deleteColumnsReply.Status, deleteFamilyReply.Status)
+	}
+
+	alter := func(args ydbserverrpc.AlterTableArgs) ydbserverrpc.AlterTableReply {
+		args.TableName = tableName
+		var reply ydbserverrpc.AlterTableReply
+		if err := client.Call("YDBServer.AlterTable", &args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	cases := []struct {
+		args ydbserverrpc.AlterTableArgs
+		want ydbserverrpc.Status
+	}{
+		{ydbserverrpc.AlterTableArgs{AddFamilies: map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {}}}, ydbserverrpc.InvalidArgument},
+		{ydbserverrpc.AlterTableArgs{AddFamilies: map[string]ydbserverrpc.ColumnFamilyOptions{"Phone:Home": {}}}, ydbserverrpc.InvalidArgument},
+		{ydbserverrpc.AlterTableArgs{AddFamilies: map[string]ydbserverrpc.ColumnFamilyOptions{"Phone": {MaxVersions: -1}}}, ydbserverrpc.InvalidArgument},
+		{ydbserverrpc.AlterTableArgs{DropFamilies: []string{"Phone"}}, ydbserverrpc.UnknownFamily},
+		{ydbserverrpc.AlterTableArgs{DropFamilies: []string{"Name", "Name"}}, ydbserverrpc.InvalidArgument},
+		{ydbserverrpc.AlterTableArgs{DropFamilies: []string{"Name"}, FamilyOptions: map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {}}}, ydbserverrpc.InvalidArgument},
+		{ydbserverrpc.AlterTableArgs{FamilyOptions: map[string]ydbserverrpc.ColumnFamilyOptions{"Phone": {}}}, ydbserverrpc.UnknownFamily},
+		{ydbserverrpc.AlterTableArgs{FamilyOptions: map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {Compression: 100}}}, ydbserverrpc.InvalidArgument},
+	}
+	for _, c := range cases {
+		if reply := alter(c.args); reply.Status != c.want {
+			t.Errorf("AlterTable %+v got status %d, want %d.", c.args, reply.Status, c.want)
+		}
+	}
+	var notFound ydbserverrpc.AlterTableReply
+	if err := client.Call("YDBServer.AlterTable", &ydbserverrpc.AlterTableArgs{TableName: "noTable"}, &notFound); err != nil {
+		t.Fatal(err)
+	}
+	if notFound.Status != ydbserverrpc.TableNotFound {
+		t.Errorf("AlterTable of a missing table got status %d.", notFound.Status)
+	}
+	if !reflect.DeepEqual(table.metadata.ColumnsFamilies, []string{"Name", "Address"}) {
+		t.Fatalf("Refused changes altered the families to %v", table.metadata.ColumnsFamilies)
+	}
+
+	// Added families take writes, options change in place
+	reply := alter(ydbserverrpc.AlterTableArgs{
+		AddFamilies:   map[string]ydbserverrpc.ColumnFamilyOptions{"Phone": {MaxVersions: 2}},
+		FamilyOptions: map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {MaxVersions: 3}},
+	})
+	if reply.Status != ydbserverrpc.OK || !reflect.DeepEqual(reply.TableHandle.ColumnFamilies, []string{"Name", "Address", "Phone"}) {
+		t.Fatalf("AlterTable got status %d and handle %+v.", reply.Status, reply.TableHandle)
+	}
+	if table.maxVersions("Name") != 3 || table.maxVersions("Phone") != 2 {
+		t.Errorf("Altered families keep %d and %d versions.", table.maxVersions("Name"), table.maxVersions("Phone"))
+	}
+	putRow(t, client, "a", map[string]string{"Phone:Home": "555"})
+
+	// A segment holding every family, as older tables have, next to the
+	// segments of every family and the memtable
+	table.dataLocker.Lock()
+	id := table.nextSegmentID
+	table.nextSegmentID++
+	legacy := newYDBColumn()
+	legacy.put("Name:First Name", YDBCell{Value: []byte("Legacy"), Timestamp: 1})
+	legacy.put("Address:City", YDBCell{Value: []byte("Old City"), Timestamp: 1})
+	addressOnly := newYDBColumn()
+	addressOnly.put("Address:City", YDBCell{Value: []byte("Gone"), Timestamp: 1})
+	seg, locs, err := table.writeSegmentFile(testServer, segmentMeta{ID: id, Seq: id}, []string{"legacy", "legacy-address"}, []YDBColumn{legacy, addressOnly}, table.metadata.segmentOptions())
+	if err == nil {
+		err = testServer.indexDB.Update(func(tx *bbolt.Tx) error {
+			segments, rowIndex, err := createTableBuckets(tx, tableName)
+			if err != nil {
+				return err
+			}
+			v, _ := json.Marshal(seg.meta)
+			if err := segments.Put(segmentKey(id), v); err != nil {
+				return err
+			}
+			return indexRows(rowIndex, []string{"legacy", "legacy-address"}, locs, nil)
+		})
+		table.segments = append(table.segments, seg)
+	}
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRow(t, client, "flushed", map[string]string{"Name:First Name": "Flushed", "Address:City": "City"})
+	table.dataLocker.Lock()
+	err = table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRow(t, client, "memory", map[string]string{"Name:First Name": "Memory", "Address:City": "City"})
+
+	// Dropping a family deletes its data wherever it is
+	reply = alter(ydbserverrpc.AlterTableArgs{DropFamilies: []string{"Address"}})
+	if reply.Status != ydbserverrpc.OK || !reflect.DeepEqual(reply.TableHandle.ColumnFamilies, []string{"Name", "Phone"}) {
+		t.Fatalf("Drop got status %d and handle %+v.", reply.Status, reply.TableHandle)
+	}
+	check := func(stage string) {
+		for _, seg := range table.snapshotSegments() {
+			if seg.meta.Family == "Address" {
+				t.Errorf("%s: segment %d of the dropped family is left", stage, seg.meta.ID)
+			}
+			it := seg.iterator()
+			for it.seek(""); it.valid(); it.next() {
+				row, _ := it.row()
+				for key := range row.Columns {
+					if columnFamily(key) == "Address" {
+						t.Errorf("%s: segment %d holds %s of %s", stage, seg.meta.ID, key, it.key())
+					}
+				}
+			}
+		}
+		for rowKey, first := range map[string]string{"legacy": "Legacy", "flushed": "Flushed", "memory": "Memory"} {
+			if row := getRow(t, client, rowKey); len(row) != 1 || row["Name:First Name"] != first {
+				t.Errorf("%s: row %s is %v after the drop", stage, rowKey, row)
+			}
+		}
+		if row := getRow(t, client, "legacy-address"); len(row) != 0 {
+			t.Errorf("%s: row of the dropped family only is %v", stage, row)
+		}
+		if row := getRow(t, client, "a"); row["Phone:Home"] != "555" {
+			t.Errorf("%s: row of another family is %v", stage, row)
+		}
+	}
+	check("dropped")
+	var putReply ydbserverrpc.PutRowReply
+	if err := client.Call("YDBServer.PutRow", &ydbserverrpc.PutRowArgs{TableName: tableName, RowKey: "memory", UpdatedColumns: map[string][]byte{"Address:City": []byte("City")}}, &putReply); err != nil {
+		t.Fatal(err)
+	}
+	if putReply.Status != ydbserverrpc.UnknownFamily {
+		t.Errorf("PutRow to a dropped family got status %d.", putReply.Status)
+	}
+
+	// The change is saved, and the family comes back empty
+	reopenTable(t, client, tableName)
+	table = testServer.tables[tableName]
+	if table.maxVersions("Name") != 3 || table.hasFamily("Address") {
+		t.Errorf("Reopened table has families %v", table.metadata.ColumnsFamilies)
+	}
+	check("reopened")
+	if reply := alter(ydbserverrpc.AlterTableArgs{AddFamilies: map[string]ydbserverrpc.ColumnFamilyOptions{"Address": {}}}); reply.Status != ydbserverrpc.OK {
+		t.Fatalf("Adding the family back got status %d.", reply.Status)
+	}
+	check("added back")
+}
+
+func TestYdbServer_TableOptions(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+
+	// Invalid options are refused
+	bad := []ydbserverrpc.TableOptions{
+		{MemTableLimit: -1},
+		{WALSyncPolicy: 7},
+		{Compression: 100},
+		{BloomFalsePositive: 1},
+		{MaxVersions: -1},
+		{TTL: -time.Second},
+		{Compaction: 5},
+		{CompactionMinSegments: 1},
+	}
+	for _, options := range bad {
+		var reply ydbserverrpc.CreateTableReply
+		if err := client.Call("YDBServer.CreateTable", &ydbserverrpc.CreateTableArgs{TableName: "badOptionsTable", Options: options}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != ydbserverrpc.InvalidArgument {
+			t.Errorf("CreateTable with options %+v got status %d.", options, reply.Status)
+		}
+	}
+
+	// The options are saved with the table and returned when it is opened
+	var closeReply ydbserverrpc.CloseTableReply
+	if err := client.Call("YDBServer.CloseTable", &ydbserverrpc.CloseTableArgs{TableName: tableName}, &closeReply); err != nil {
+		t.Fatal(err)
+	}
+	var destroyReply ydbserverrpc.DestroyTableReply
+	if err := client.Call("YDBServer.DestroyTable", &ydbserverrpc.DestroyTableArgs{TableName: tableName}, &destroyReply); err != nil {
+		t.Fatal(err)
+	}
+	options := ydbserverrpc.TableOptions{
+		MemTableLimit:         1 << 20,
+		WALSyncPolicy:         ydbserverrpc.SyncEveryWrite,
+		Compression:           ydbserverrpc.CompressionGzip,
+		BloomFalsePositive:    0.05,
+		MaxVersions:           2,
+		TTL:                   time.Hour,
+		Compaction:            ydbserverrpc.CompactionManual,
+		CompactionMinSegments: 2,
+	}
+	createArgs := &ydbserverrpc.CreateTableArgs{
+		TableName:      tableName,
+		ColumnFamilies: []string{"Name", "Address"},
+		FamilyOptions:  map[string]ydbserverrpc.ColumnFamilyOptions{"Address": {MaxVersions: 5, HasTTL: true, HasCompression: true}},
+		Options:        options,
+	}
+	var createReply ydbserverrpc.CreateTableReply
+	if err := client.Call("YDBServer.CreateTable", createArgs, &createReply); err != nil {
+		t.Fatal(err)
+	}
+	if createReply.Status != ydbserverrpc.OK || createReply.TableHandle.Options != options {
+		t.Fatalf("CreateTable got status %d and options %+v.", createReply.Status, createReply.TableHandle.Options)
+	}
+	var openReply ydbserverrpc.OpenTableReply
+	if err := client.Call("YDBServer.OpenTable", &ydbserverrpc.OpenTableArgs{TableName: tableName}, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	if openReply.Status != ydbserverrpc.OK || openReply.TableHandle.Options != options {
+		t.Fatalf("OpenTable got status %d and options %+v.", openReply.Status, openReply.TableHandle.Options)
+	}
+
+	// Table wide cell options apply to families without their own
+	table := testServer.tables[tableName]
+	if table.maxVersions("Name") != 2 || table.maxVersions("Address") != 5 || table.ttl("Name") != time.Hour {
+		t.Errorf("Families keep %d and %d versions for %v.", table.maxVersions("Name"), table.maxVersions("Address"), table.ttl("Name"))
+	}
+	if table.compression("Name") != ydbserverrpc.CompressionGzip || table.bloomFalsePositive() != 0.05 || table.wal.policy != ydbserverrpc.SyncEveryWrite {
+		t.Errorf("Table writes with codec %d, bloom filters of %v and sync policy %d.", table.compression("Name"), table.bloomFalsePositive(), table.wal.policy)
+	}
+	if table.compression("Address") != ydbserverrpc.CompressionNone || table.ttl("Address") != 0 {
+		t.Errorf("Family set to no codec and no TTL writes with codec %d and a TTL of %v.", table.compression("Address"), table.ttl("Address"))
+	}
+
+	// Manual compaction leaves segments alone until asked
+	for i := 0; i < 3; i++ {
+		putRow(t, client, fmt.Sprintf("opt%d", i), map[string]string{"Name:First Name": "First" + strconv.Itoa(i)})
+		table.dataLocker.Lock()
+		err := table.flush(testServer)
+		table.dataLocker.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inputs := table.pickCompaction(false); inputs != nil {
+		t.Errorf("Manual compaction picked %d segments", len(inputs))
+	}
+
+	// Options change on the open table
+	options.Compaction = ydbserverrpc.CompactionSizeTiered
+	options.WALSyncPolicy = ydbserverrpc.SyncInterval
+	options.MaxVersions = 3
+	var alterReply ydbserverrpc.AlterTableReply
+	if err := client.Call("YDBServer.AlterTable", &ydbserverrpc.AlterTableArgs{TableName: tableName, Options: &options}, &alterReply); err != nil {
+		t.Fatal(err)
+	}
+	if alterReply.Status != ydbserverrpc.OK || alterReply.TableHandle.Options != options {
+		t.Fatalf("AlterTable got status %d and options %+v.", alterReply.Status, alterReply.TableHandle.Options)
+	}
+	if table.wal.policy != ydbserverrpc.SyncInterval || table.maxVersions("Name") != 3 {
+		t.Errorf("Altered table syncs with policy %d and keeps %d versions.", table.wal.policy, table.maxVersions("Name"))
+	}
+	for i := 0; i < 500 && len(table.snapshotSegments()) > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if segments := table.snapshotSegments(); len(segments) != 1 {
+		t.Errorf("Size-tiered compaction left %d segments", len(segments))
+	}
+	putRow(t, client, "opt9", map[string]string{"Name:First Name": "After"})
+	if err := client.Call("YDBServer.AlterTable", &ydbserverrpc.AlterTableArgs{TableName: tableName, Options: &ydbserverrpc.TableOptions{CompactionMinSegments: 1}}, &alterReply); err != nil {
+		t.Fatal(err)
+	}
+	if alterReply.Status != ydbserverrpc.InvalidArgument {
+		t.Errorf("AlterTable with invalid options got status %d.", alterReply.Status)
+	}
+	reopenTable(t, client, tableName)
+	table = testServer.tables[tableName]
+	if got := table.metadata.options(); got != options {
+		t.Errorf("Reopened table has options %+v", got)
+	}
+	for i, first := range []string{"First0", "First1", "First2"} {
+		if row := getRow(t, client, fmt.Sprintf("opt%d", i)); row["Name:First Name"] != first {
+			t.Errorf("Wrong row %v", row)
+		}
+	}
+	if row := getRow(t, client, "opt9"); row["Name:First Name"] != "After" {
+		t.Errorf("Write after the WAL moved is %v", row)
+	}
+
+	// Metadata of the first format has a row limit, which is replaced once
+	if err := client.Call("YDBServer.CloseTable", &ydbserverrpc.CloseTableArgs{TableName: tableName}, &closeReply); err != nil {
+		t.Fatal(err)
+	}
+	tableMetaFilename, _ := formatFilename(tableName)
+	metadata := new(TableMeta)
+	if err := readGob(tableMetaFilename, metadata); err != nil || metadata.Version != tableMetaVersion {
+		t.Fatalf("Saved metadata of version %d, %v", metadata.Version, err)
+	}
+	metadata.Version = 0
+	metadata.MemTableLimit = 9000
+	if err := writeGob(tableMetaFilename, metadata); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("YDBServer.OpenTable", &ydbserverrpc.OpenTableArgs{TableName: tableName}, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	if openReply.TableHandle.Options.MemTableLimit != defaultMemTableLimit {
+		t.Errorf("Row limit opened as a budget of %d", openReply.TableHandle.Options.MemTableLimit)
+	}
+	var limitReply ydbserverrpc.MemTableLimitReply
+	if err := client.Call("YDBServer.MemTableLimit", &ydbserverrpc.MemTableLimitArgs{TableName: tableName, NewLimitBytes: 9000}, &limitReply); err != nil {
+		t.Fatal(err)
+	}
+	reopenTable(t, client, tableName)
+	if got := testServer.tables[tableName].metadata.MemTableLimit; got != 9000 {
+		t.Errorf("Budget of 9000 bytes reopened as %d", got)
+	}
+}
+
+func TestYdbServer_ConfigureTable(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+	tableMetaFilename, _ := formatFilename(tableName)
+
+	memTableLimit := func(name string, limit int64) ydbserverrpc.Status {
+		var reply ydbserverrpc.MemTableLimitReply
+		if err := client.Call("YDBServer.MemTableLimit", &ydbserverrpc.MemTableLimitArgs{TableName: name, NewLimitBytes: limit}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Status
+	}
+	waitFlushed := func() {
+		table.dataLocker.Lock()
+		for table.immutable != nil && table.flushErr == nil {
+			table.flushed.Wait()
+		}
+		table.dataLocker.Unlock()
+	}
+	memTableSize := func() int64 {
+		table.dataLocker.RLock()
+		defer table.dataLocker.RUnlock()
+		return table.data.size()
+	}
+	value := strings.Repeat("v", 1000)
+
+	// Compaction is left to CompactTable so every flush shows
+	var configureReply ydbserverrpc.ConfigureTableReply
+	configureArgs := &ydbserverrpc.ConfigureTableArgs{TableName: tableName, Options: ydbserverrpc.TableOptions{Compaction: ydbserverrpc.CompactionManual}}
+	if err := client.Call("YDBServer.ConfigureTable", configureArgs, &configureReply); err != nil {
+		t.Fatal(err)
+	}
+	if configureReply.Status != ydbserverrpc.OK || configureReply.TableHandle.Options.MemTableLimit != defaultMemTableLimit {
+		t.Fatalf("ConfigureTable got status %d and options %+v.", configureReply.Status, configureReply.TableHandle.Options)
+	}
+	configureArgs.Options.CompactionMinSegments = 1
+	if err := client.Call("YDBServer.ConfigureTable", configureArgs, &configureReply); err != nil {
+		t.Fatal(err)
+	}
+	if configureReply.Status != ydbserverrpc.InvalidArgument {
+		t.Errorf("ConfigureTable with invalid options got status %d.", configureReply.Status)
+	}
+
+	// Under the default budget the rows stay in memory
+	for i := 0; i < 20; i++ {
+		putRow(t, client, fmt.Sprintf("cfg%02d", i), map[string]string{"Name:First Name": value})
+	}
+	waitFlushed()
+	if n := len(table.snapshotSegments()); n != 0 {
+		t.Fatalf("%d segments flushed under the default budget", n)
+	}
+
+	// A smaller budget flushes the memtable over it at once, and later
+	// writes whenever they fill it
+	const limit = 8 * 1024
+	if status := memTableLimit(tableName, limit); status != ydbserverrpc.OK {
+		t.Fatalf("MemTableLimit got status %d.", status)
+	}
+	waitFlushed()
+	if n := len(table.snapshotSegments()); n != 1 || memTableSize() != 0 {
+		t.Fatalf("%d segments and %d bytes in memory after the budget shrank", n, memTableSize())
+	}
+	for i := 20; i < 60; i++ {
+		putRow(t, client, fmt.Sprintf("cfg%02d", i), map[string]string{"Name:First Name": value})
+		if size := memTableSize(); size > limit+2*int64(len(value)) {
+			t.Fatalf("Memtable grew to %d bytes with a budget of %d", size, limit)
+		}
+	}
+	waitFlushed()
+	if n := len(table.snapshotSegments()); n < 4 {
+		t.Errorf("%d segments after writing 40KB with a budget of 8KB", n)
+	}
+	if table.metadata.Compaction != ydbserverrpc.CompactionManual {
+		t.Errorf("MemTableLimit changed the compaction strategy to %d", table.metadata.Compaction)
+	}
+
+	// The change is saved with write-then-rename and outlives the table
+	saved := new(TableMeta)
+	if err := readGob(tableMetaFilename, saved); err != nil || saved.MemTableLimit != limit {
+		t.Errorf("Saved budget %d, %v", saved.MemTableLimit, err)
+	}
+	if _, err := os.Stat(tableMetaFilename + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Temporary metadata file left: %v", err)
+	}
+	reopenTable(t, client, tableName)
+	table = testServer.tables[tableName]
+	if table.metadata.MemTableLimit != limit {
+		t.Errorf("Reopened table has a budget of %d", table.metadata.MemTableLimit)
+	}
+	for _, i := range []int{0, 19, 59} {
+		if row := getRow(t, client, fmt.Sprintf("cfg%02d", i)); row["Name:First Name"] != value {
+			t.Errorf("Row cfg%02d lost", i)
+		}
+	}
+
+	// Tables that are not open are configured on disk
+	var closeReply ydbserverrpc.CloseTableReply
+	if err := client.Call("YDBServer.CloseTable", &ydbserverrpc.CloseTableArgs{TableName: tableName}, &closeReply); err != nil {
+		t.Fatal(err)
+	}
+	if status := memTableLimit(tableName, 2*limit); status != ydbserverrpc.OK {
+		t.Errorf("MemTableLimit of a closed table got status %d.", status)
+	}
+	var openReply ydbserverrpc.OpenTableReply
+	if err := client.Call("YDBServer.OpenTable", &ydbserverrpc.OpenTableArgs{TableName: tableName}, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	if openReply.TableHandle.MemTableLimit != 2*limit || openReply.TableHandle.Options.Compaction != ydbserverrpc.CompactionManual {
+		t.Errorf("Table configured while closed opened with options %+v", openReply.TableHandle.Options)
+	}
+	if status := memTableLimit("noTable", limit); status != ydbserverrpc.TableNotFound {
+		t.Errorf("MemTableLimit of a missing table got status %d.", status)
+	}
+	if status := memTableLimit(tableName, 0); status != ydbserverrpc.InvalidArgument {
+		t.Errorf("Zero budget got status %d.", status)
+	}
+
+	// Concurrent changes take turns restarting the compactor
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			switch i % 3 {
+			case 0:
+				var reply ydbserverrpc.ConfigureTableReply
+				err = client.Call("YDBServer.ConfigureTable", &ydbserverrpc.ConfigureTableArgs{TableName: tableName, Options: ydbserverrpc.TableOptions{MemTableLimit: limit}}, &reply)
+			case 1:
+				var reply ydbserverrpc.MemTableLimitReply
+				err = client.Call("YDBServer.MemTableLimit", &ydbserverrpc.MemTableLimitArgs{TableName: tableName, NewLimitBytes: limit}, &reply)
+			case 2:
+				var reply ydbserverrpc.AlterTableReply
+				err = client.Call("YDBServer.AlterTable", &ydbserverrpc.AlterTableArgs{TableName: tableName}, &reply)
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Options change while a large memtable is flushed in the background
+	setMemTableLimit(tableName, 100000*testRowBytes)
+	for i := 0; i < 3000; i++ {
+		putRow(t, client, fmt.Sprintf("big%04d", i), map[string]string{"Name:First Name": value, "Address:City": value})
+	}
+	table = testServer.tables[tableName]
+	table.dataLocker.Lock()
+	err := table.freeze()
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushing := func() bool {
+		table := testServer.tables[tableName]
+		table.dataLocker.RLock()
+		defer table.dataLocker.RUnlock()
+		if table.flushErr != nil {
+			t.Fatal(table.flushErr)
+		}
+		return table.immutable != nil
+	}
+	for i := 0; flushing(); i++ {
+		if i%2 == 0 {
+			options := ydbserverrpc.TableOptions{MemTableLimit: limit, Compression: ydbserverrpc.CompressionGzip, BloomFalsePositive: 0.05, TTL: time.Duration(i+1) * time.Hour}
+			var reply ydbserverrpc.ConfigureTableReply
+			err = client.Call("YDBServer.ConfigureTable", &ydbserverrpc.ConfigureTableArgs{TableName: tableName, Options: options}, &reply)
+		} else {
+			families := map[string]ydbserverrpc.ColumnFamilyOptions{"Address": {TTL: time.Duration(i) * time.Hour, Compression: ydbserverrpc.CompressionGzip}}
+			var reply ydbserverrpc.AlterTableReply
+			err = client.Call("YDBServer.AlterTable", &ydbserverrpc.AlterTableArgs{TableName: tableName, FamilyOptions: families}, &reply)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range []int{0, 1500, 2999} {
+		if row := getRow(t, client, fmt.Sprintf("big%04d", i)); row["Address:City"] != value {
+			t.Errorf("Row big%04d flushed during option changes lost: %v", i, row)
+		}
+	}
+}
+
+func TestYdbServer_ConfigureTable_Nodes(t *testing.T) {
+	const clusterTable = "clusterTable"
+	const masterTable = "masterTable"
+	ports := make([]int, 2)
+	for i := range ports {
+		port, err := freeport.GetFreePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = port
+	}
+	dir, err := ioutil.TempDir("", "ydbnode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Remove("index_db100")
+
+	// The slave runs in a process of its own, in another directory, so the
+	// nodes share no table files
+	slave := exec.Command(os.Args[0], "-test.run=^$")
+	slave.Env = append(os.Environ(),
+		testNodeDirEnv+"="+dir,
+		testNodeMasterEnv+"=localhost:"+strconv.Itoa(ports[0]),
+		testNodePortEnv+"="+strconv.Itoa(ports[1]))
+	if err := slave.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer slave.Process.Kill()
+	var master *ydbServer
+	started := make(chan error, 1)
+	go func() {
+		server, err := NewYDBServer("", 2, ports[0], 100)
+		if err == nil {
+			master = server.(*ydbServer)
+		}
+		started <- err
+	}()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("The slave did not register.")
+	}
+	masterClient, err := rpc.DialHTTP("tcp", "localhost:"+strconv.Itoa(ports[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slaveClient, err := rpc.DialHTTP("tcp", "localhost:"+strconv.Itoa(ports[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both nodes host clusterTable with options of their own, only the master
+	// has it open. masterTable is on the master only.
+	create := func(client *rpc.Client, name string, options ydbserverrpc.TableOptions) {
+		var createReply ydbserverrpc.CreateTableReply
+		if err := client.Call("YDBServer.CreateTable", &ydbserverrpc.CreateTableArgs{TableName: name, ColumnFamilies: []string{"Name"}, Options: options}, &createReply); err != nil {
+			t.Fatal(err)
+		}
+		if createReply.Status != ydbserverrpc.OK {
+			t.Fatalf("CreateTable of %s got status %d.", name, createReply.Status)
+		}
+	}
+	create(masterClient, clusterTable, ydbserverrpc.TableOptions{MaxVersions: 2})
+	create(masterClient, masterTable, ydbserverrpc.TableOptions{})
+	create(slaveClient, clusterTable, ydbserverrpc.TableOptions{MaxVersions: 5})
+	var openReply ydbserverrpc.OpenTableReply
+	if err := masterClient.Call("YDBServer.OpenTable", &ydbserverrpc.OpenTableArgs{TableName: clusterTable}, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		var closeReply ydbserverrpc.CloseTableReply
+		masterClient.Call("YDBServer.CloseTable", &ydbserverrpc.CloseTableArgs{TableName: clusterTable}, &closeReply)
+		for _, name := range []string{clusterTable, masterTable} {
+			var destroyReply ydbserverrpc.DestroyTableReply
+			masterClient.Call("YDBServer.DestroyTable", &ydbserverrpc.DestroyTableArgs{TableName: name}, &destroyReply)
+		}
+	}()
+	slaveMeta := func() *TableMeta {
+		tableMetaFilename, _ := formatFilename(clusterTable)
+		metadata := new(TableMeta)
+		if err := readGob(filepath.Join(dir, tableMetaFilename), metadata); err != nil {
+			t.Fatal(err)
+		}
+		return metadata
+	}
+	checkNodes := func(nodes []ydbserverrpc.NodeStatus, nodeID uint32, status ydbserverrpc.Status) {
+		if len(nodes) != 1 || nodes[0].Node.NodeID != nodeID || nodes[0].Status != status {
+			t.Errorf("Expected node %d to reply %d, got %+v", nodeID, status, nodes)
+		}
+	}
+	memTableLimit := func(client *rpc.Client, name string, limit int64) *ydbserverrpc.MemTableLimitReply {
+		var reply ydbserverrpc.MemTableLimitReply
+		if err := client.Call("YDBServer.MemTableLimit", &ydbserverrpc.MemTableLimitArgs{TableName: name, NewLimitBytes: limit}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return &reply
+	}
+
+	// A budget set through the slave reaches the open table of the master,
+	// and each node keeps its other options
+	reply := memTableLimit(slaveClient, clusterTable, 12345)
+	if reply.Status != ydbserverrpc.OK {
+		t.Fatalf("MemTableLimit got status %d.", reply.Status)
+	}
+	checkNodes(reply.Nodes, 100, ydbserverrpc.OK)
+	table := master.tables[clusterTable]
+	table.dataLocker.RLock()
+	options := table.metadata.options()
+	table.dataLocker.RUnlock()
+	if options.MemTableLimit != 12345 || options.MaxVersions != 2 {
+		t.Errorf("Master table has options %+v", options)
+	}
+	if metadata := slaveMeta(); metadata.MemTableLimit != 12345 || metadata.MaxVersions != 5 {
+		t.Errorf("Slave table has options %+v", metadata.options())
+	}
+
+	// A node without the table still passes the change on
+	reply = memTableLimit(slaveClient, masterTable, 23456)
+	if reply.Status != ydbserverrpc.OK {
+		t.Errorf("MemTableLimit of a table on the master only got status %d.", reply.Status)
+	}
+	checkNodes(reply.Nodes, 100, ydbserverrpc.OK)
+	tableMetaFilename, _ := formatFilename(masterTable)
+	metadata := new(TableMeta)
+	if err := readGob(tableMetaFilename, metadata); err != nil || metadata.MemTableLimit != 23456 {
+		t.Errorf("Master table has a budget of %d, %v", metadata.MemTableLimit, err)
+	}
+	reply = memTableLimit(slaveClient, "noTable", 12345)
+	if reply.Status != ydbserverrpc.TableNotFound {
+		t.Errorf("MemTableLimit of a missing table got status %d.", reply.Status)
+	}
+	checkNodes(reply.Nodes, 100, ydbserverrpc.TableNotFound)
+
+	// ConfigureTable sets all the options everywhere
+	var configureReply ydbserverrpc.ConfigureTableReply
+	configureArgs := &ydbserverrpc.ConfigureTableArgs{TableName: clusterTable, Options: ydbserverrpc.TableOptions{MaxVersions: 3}}
+	if err := masterClient.Call("YDBServer.ConfigureTable", configureArgs, &configureReply); err != nil {
+		t.Fatal(err)
+	}
+	if configureReply.Status != ydbserverrpc.OK || configureReply.TableHandle.Options.MaxVersions != 3 {
+		t.Errorf("ConfigureTable got status %d and options %+v.", configureReply.Status, configureReply.TableHandle.Options)
+	}
+	checkNodes(configureReply.Nodes, 101, ydbserverrpc.OK)
+	if len(configureReply.FailedNodes) != 0 {
+		t.Errorf("ConfigureTable failed on nodes %+v", configureReply.FailedNodes)
+	}
+	if metadata := slaveMeta(); metadata.MemTableLimit != defaultMemTableLimit || metadata.MaxVersions != 3 {
+		t.Errorf("Slave table has options %+v", metadata.options())
+	}
+
+	// A node that is down fails the call, the others are configured anyway
+	slave.Process.Kill()
+	slave.Wait()
+	configureArgs.Options.MaxVersions = 4
+	configureReply = ydbserverrpc.ConfigureTableReply{}
+	if err := masterClient.Call("YDBServer.ConfigureTable", configureArgs, &configureReply); err != nil {
+		t.Fatal(err)
+	}
+	if configureReply.Status != ydbserverrpc.NodeUnavailable || configureReply.TableHandle.Options.MaxVersions != 4 {
+		t.Errorf("ConfigureTable got status %d and options %+v.", configureReply.Status, configureReply.TableHandle.Options)
+	}
+	if len(configureReply.FailedNodes) != 1 || configureReply.FailedNodes[0].NodeID != 101 {
+		t.Errorf("Expected node 101 to be listed as failed, got %+v", configureReply.FailedNodes)
+	}
+	checkNodes(configureReply.Nodes, 101, ydbserverrpc.NodeUnavailable)
+	if len(configureReply.Nodes) == 1 && configureReply.Nodes[0].Error == "" {
+		t.Errorf("No error for the node that is down")
+	}
+}
+
+// runTestNode runs a slave node of the multi-node tests in dir until the
+// process is killed.
+func runTestNode(dir string) {
+	if err := os.Chdir(dir); err != nil {
+		panic(err)
+	}
+	port, err := strconv.Atoi(os.Getenv(testNodePortEnv))
+	if err != nil {
+		panic(err)
+	}
+	if _, err := NewYDBServer(os.Getenv(testNodeMasterEnv), 2, port, 101); err != nil {
+		panic(err)
+	}
+	select {}
+}
+
+func TestMemTable(t *testing.T) {
+	m := newMemTable()
+	keys := rand.Perm(1000)
+	for _, i := range keys {
+		m.update(fmt.Sprintf("row%04d", i), func(col *YDBColumn) {
+			col.put("Name:First Name", YDBCell{Value: []byte("First"), Timestamp: 1})
+		})
+	}
+	if m.len() != 1000 {
+		t.Fatalf("Memtable holds %d rows, want 1000.", m.len())
+	}
+
+	// Rows come back in key order from any start
+	it := m.iterator()
+	n := 0
+	for it.seek("row0500"); it.valid(); it.next() {
+		if want := fmt.Sprintf("row%04d", 500+n); it.key() != want {
+			t.Fatalf("Got row %s, want %s.", it.key(), want)
+		}
+		n++
+	}
+	if n != 500 {
+		t.Errorf("Iterated %d rows, want 500.", n)
+	}
+
+	// The size follows rows growing and shrinking
+	before := m.size()
+	m.update("row0001", func(col *YDBColumn) {
+		col.put("Name:Last Name", YDBCell{Value: []byte(strings.Repeat("x", 1000)), Timestamp: 2})
+	})
+	if grown := m.size() - before; grown < 1000 {
+		t.Errorf("Size grew by %d bytes for a 1000 byte value.", grown)
+	}
+	col := newYDBColumn()
+	m.set("row0001", col)
+	if m.size() >= before {
+		t.Errorf("Size %d not below %d after replacing a row with an empty one.", m.size(), before)
+	}
+}
+
+func TestYdbServer_BackgroundFlush(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+	table.stopFlusher()
+
+	// A full memtable is frozen and the write returns before it is flushed
+	putRows := func(from int, to int) {
+		for i := from; i < to; i++ {
+			putRow(t, client, fmt.Sprintf("row%03d", i), map[string]string{"Name:First Name": fmt.Sprintf("First%03d", i)})
+		}
+	}
+	putRows(0, 1)
+	table.dataLocker.RLock()
+	rowBytes := table.data.size()
+	table.dataLocker.RUnlock()
+	setMemTableLimit(tableName, 10*rowBytes)
+	putRows(1, 11)
+	table.dataLocker.RLock()
+	frozen, segments := table.immutable.len(), len(table.segments)
+	table.dataLocker.RUnlock()
+	if frozen != 11 || segments != 0 {
+		t.Fatalf("Frozen %d rows with %d segments, want 11 rows and none.", frozen, segments)
+	}
+	if row := getRow(t, client, "row005"); row["Name:First Name"] != "First005" {
+		t.Errorf("Row of the frozen memtable not readable: %v", row)
+	}
+
+	// The next full memtable waits for the pending flush
+	written := make(chan struct{})
+	go func() {
+		putRows(11, 22)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("Write not held back by the pending flush.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if row := getRow(t, client, "row015"); row["Name:First Name"] != "First015" {
+		t.Errorf("Row of the live memtable not readable: %v", row)
+	}
+	table.startFlusher(testServer)
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write still held back after the flush.")
+	}
+
+	table.dataLocker.Lock()
+	err := table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.immutable != nil || len(table.segments) != 2 {
+		t.Errorf("Expected 2 flushed segments, got %d.", len(table.segments))
+	}
+	reopenTable(t, client, tableName)
+	for i := 0; i < 22; i++ {
+		if row := getRow(t, client, fmt.Sprintf("row%03d", i)); row["Name:First Name"] != fmt.Sprintf("First%03d", i) {
+			t.Errorf("Wrong row %d after flush: %v", i, row)
+		}
+	}
+}
+
+func TestYdbServer_CompactTable(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	setMemTableLimit(tableName, 30*testRowBytes)
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			putRow(t, client, fmt.Sprintf("row%03d", i), map[string]string{
+				"Name:Last Name": "Last" + strconv.Itoa(round),
+			})
+		}
+	}
+
+	var compactReply ydbserverrpc.CompactTableReply
+	if err := client.Call("YDBServer.CompactTable", &ydbserverrpc.CompactTableArgs{TableName: tableName}, &compactReply); err != nil {
+		t.Fatal(err)
+	}
+	if compactReply.Status != ydbserverrpc.OK {
+		t.Fatalf("CompactTable failed with status %d.", compactReply.Status)
+	}
+
+	// Wait for the manual compaction to merge everything
+	var progress ydbserverrpc.CompactionProgress
+	for i := 0; i < 100; i++ {
+		var progressReply ydbserverrpc.GetCompactionProgressReply
+		if err := client.Call("YDBServer.GetCompactionProgress", &ydbserverrpc.GetCompactionProgressArgs{TableName: tableName}, &progressReply); err != nil {
+			t.Fatal(err)
+		}
+		progress = progressReply.Progress
+		if !progress.Running && progress.Manual && progress.Segments == 1 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if progress.Segments != 1 || progress.LastError != "" || progress.RowsWritten != 100 {
+		t.Fatalf("Compaction did not finish: %+v", progress)
+	}
+
+	// Obsolete segment files are gone and the row index points at the output
+	table := testServer.tables[tableName]
+	files, _ := filepath.Glob(tableName + ".*.sst")
+	if len(files) != 1 || len(table.segments) != 1 {
+		t.Errorf("Expected one segment, got files %v.", files)
+	}
+	testServer.indexDB.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket([]byte(tableName)).Bucket(rowIndexBucket).Get([]byte("row042"))
+		locs, _ := decodeRowLocations(v)
+		if len(locs) != 1 || locs[0].Segment != table.segments[0].meta.ID || locs[0].Offset < 0 {
+			t.Errorf("Row index not rewritten: %v", locs)
+		}
+		return nil
+	})
+	if row := getRow(t, client, "row042"); row["Name:Last Name"] != "Last2" {
+		t.Errorf("Wrong row after compaction: %v", row)
+	}
+}
+
+func TestYdbServer_BloomFilter(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	setMemTableLimit(tableName, 500*testRowBytes)
+
+	for i := 0; i < 1000; i++ {
+		putRow(t, client, fmt.Sprintf("row%04d", i), map[string]string{
+			"Name:First Name": "First",
+		})
+	}
+	reopenTable(t, client, tableName)
+
+	// Filters are loaded with the segments and never rule out a stored key
+	table := testServer.tables[tableName]
+	falsePositives := 0
+	for _, seg := range table.segments {
+		if seg.filter == nil {
+			t.Fatalf("Segment %d has no bloom filter.", seg.meta.ID)
+		}
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("row%04d", i)
+			if key >= seg.meta.MinKey && key <= seg.meta.MaxKey && !seg.mayContain(key) {
+				t.Fatalf("Bloom filter rules out stored key %s.", key)
+			}
+			if seg.filter.mayContain(fmt.Sprintf("missing%04d", i)) {
+				falsePositives++
+			}
+		}
+	}
+	if rate := float64(falsePositives) / float64(1000*len(table.segments)); rate > 3*defaultBloomFalsePositive {
+		t.Errorf("False positive rate %v too high.", rate)
+	}
+	if row := getRow(t, client, "row0500x"); len(row) != 0 {
+		t.Errorf("Expected empty row, got %v", row)
+	}
+
+	createTableArgs := &ydbserverrpc.CreateTableArgs{
+		TableName: "badBloomTable",
+		Options:   ydbserverrpc.TableOptions{BloomFalsePositive: 1.5},
+	}
+	var createTableReply ydbserverrpc.CreateTableReply
+	if err := client.Call("YDBServer.CreateTable", createTableArgs, &createTableReply); err != nil {
+		t.Fatal(err)
+	}
+	if createTableReply.Status != ydbserverrpc.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %d.", createTableReply.Status)
+	}
+}
+
+func TestYdbServer_BlockCache(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	setMemTableLimit(tableName, 30*testRowBytes)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			putRow(t, client, fmt.Sprintf("row%03d", i), map[string]string{
+				"Name:Last Name": "Last" + strconv.Itoa(round),
+			})
+		}
+	}
+
+	getStats := func() ydbserverrpc.CacheStats {
+		var reply ydbserverrpc.GetCacheStatsReply
+		if err := client.Call("YDBServer.GetCacheStats", &ydbserverrpc.GetCacheStatsArgs{}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Stats
+	}
+
+	// The second read of a row is served from memory
+	getRow(t, client, "row007")
+	before := getStats()
+	getRow(t, client, "row007")
+	after := getStats()
+	if after.Hits <= before.Hits || after.Misses != before.Misses {
+		t.Errorf("Expected only cache hits, before %+v after %+v.", before, after)
+	}
+
+	// Deleted segment files leave the cache
+	inputs := testServer.tables[tableName].snapshotSegments()
+	compactAll(t, testServer.tables[tableName])
+	for _, seg := range inputs {
+		if _, ok := testServer.blockCache.files[seg.path]; ok {
+			t.Errorf("Cache still holds deleted file %s.", seg.path)
+		}
+	}
+	if row := getRow(t, client, "row007"); row["Name:Last Name"] != "Last1" {
+		t.Errorf("Wrong row after compaction: %v", row)
+	}
+
+	// Least recently used entries are evicted first
+	cache := newBlockCache(10)
+	cache.put("a", blockCacheKey{0, 4}, []byte("aaaa"))
+	cache.put("a", blockCacheKey{4, 4}, []byte("bbbb"))
+	cache.get("a", blockCacheKey{0, 4})
+	cache.put("b", blockCacheKey{0, 4}, []byte("cccc"))
+	if _, ok := cache.get("a", blockCacheKey{4, 4}); ok {
+		t.Error("Expected least recently used entry to be evicted.")
+	}
+	if _, ok := cache.get("a", blockCacheKey{0, 4}); !ok {
+		t.Error("Expected recently used entry to stay.")
+	}
+	if stats := cache.stats(); stats.Size != 8 || stats.Entries != 2 {
+		t.Errorf("Wrong cache stats %+v.", stats)
+	}
+}
+
+func TestYdbServer_Delete(t *testing.T) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	setMemTableLimit(tableName, 30*testRowBytes)
+
+	for i := 0; i < 100; i++ {
+		putRow(t, client, fmt.Sprintf("row%03d", i), map[string]string{
+			"Name:First Name": "First",
+			"Name:Last Name":  "Last",
+			"Address:City":    "City",
+		})
+	}
+
+	var deleteRowReply ydbserverrpc.DeleteRowReply
+	for _, rowKey := range []string{"row010", "row011", "row095"} {
+		if err := client.Call("YDBServer.DeleteRow", &ydbserverrpc.DeleteRowArgs{TableName: tableName, RowKey: rowKey}, &deleteRowReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleteColumnsArgs := &ydbserverrpc.DeleteColumnsArgs{
+		TableName:           tableName,
+		RowKey:              "row020",
+		QualifiedColumnKeys: []string{"Name:First Name"},
+	}
+	var deleteColumnsReply ydbserverrpc.DeleteColumnsReply
+	if err := client.Call("YDBServer.DeleteColumns", deleteColumnsArgs, &deleteColumnsReply); err != nil {
+		t.Fatal(err)
+	}
+	deleteFamilyArgs := &ydbserverrpc.DeleteFamilyArgs{
+		TableName: tableName,
+		RowKey:    "row030",
+		Family:    "Address",
+	}
+	var deleteFamilyReply ydbserverrpc.DeleteFamilyReply
+	if err := client.Call("YDBServer.DeleteFamily", deleteFamilyArgs, &deleteFamilyReply); err != nil {
+		t.Fatal(err)
+	}
+	if deleteRowReply.Status != ydbserverrpc.OK || deleteColumnsReply.Status != ydbserverrpc.OK || deleteFamilyReply.Status != ydbserverrpc.OK {
+		t.Fatal("Delete failed.")
+	}
 
-func TestYdbServer_GetRow(t *testing.T) {
+	// Like PutRow, deletes need a row key
+	deleteColumnsArgs.RowKey, deleteFamilyArgs.RowKey = "", ""
+	if err := client.Call("YDBServer.DeleteRow", &ydbserverrpc.DeleteRowArgs{TableName: tableName}, &deleteRowReply); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("YDBServer.DeleteColumns", deleteColumnsArgs, &deleteColumnsReply); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("YDBServer.DeleteFamily", deleteFamilyArgs, &deleteFamilyReply); err != nil {
+		t.Fatal(err)
+	}
+	if deleteRowReply.Status != ydbserverrpc.InvalidArgument || deleteColumnsReply.Status != ydbserverrpc.InvalidArgument || deleteFamilyReply.Status != ydbserverrpc.InvalidArgument {
+		t.Errorf("Deletes without a row key got status %d, %d and %d.", deleteRowReply.Status, deleteColumnsReply.Status, deleteFamilyReply.Status)
+	}
+	// A put after a delete brings the row back with the new columns only
+	putRow(t, client, "row010", map[string]string{"Name:First Name": "Again"})
+
+	checkRows := func(stage string) {
+		if row := getRow(t, client, "row011"); len(row) != 0 {
+			t.Errorf("%s: deleted row returned %v", stage, row)
+		}
+		if row := getRow(t, client, "row095"); len(row) != 0 {
+			t.Errorf("%s: deleted row returned %v", stage, row)
+		}
+		if row := getRow(t, client, "row010"); len(row) != 1 || row["Name:First Name"] != "Again" {
+			t.Errorf("%s: wrong row after delete and put %v", stage, row)
+		}
+		if row := getRow(t, client, "row020"); len(row) != 2 || row["Name:First Name"] != "" {
+			t.Errorf("%s: wrong row after column delete %v", stage, row)
+		}
+		if row := getRow(t, client, "row030"); len(row) != 2 || row["Address:City"] != "" {
+			t.Errorf("%s: wrong row after family delete %v", stage, row)
+		}
+
+		getRowsArgs := &ydbserverrpc.GetRowsArgs{
+			TableName:   tableName,
+			StartRowKey: "row000",
+			EndRowKey:   "row089",
+		}
+		var getRowsReply ydbserverrpc.GetRowsReply
+		if err := client.Call("YDBServer.GetRows", getRowsArgs, &getRowsReply); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := getRowsReply.Rows["row011"]; ok {
+			t.Errorf("%s: deleted row in range scan", stage)
+		}
+		if _, ok := getRowsReply.Rows["row010"]; !ok {
+			t.Errorf("%s: rewritten row missing in range scan", stage)
+		}
+	}
+	checkRows("memtable")
+
+	// Tombstones survive WAL replay and flush
+	reopenTable(t, client, tableName)
+	checkRows("recovered")
+	table := testServer.tables[tableName]
+	table.dataLocker.Lock()
+	err := table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRows("flushed")
+
+	// A full compaction drops deleted rows from disk and from the row index
+	compactAll(t, table)
+	checkRows("compacted")
+	testServer.indexDB.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket([]byte(tableName)).Bucket(rowIndexBucket).Get([]byte("row011")); v != nil {
+			t.Errorf("Deleted row still indexed: %s", v)
+		}
+		return nil
+	})
+	if _, ok, _ := table.segments[0].get("row011"); ok {
+		t.Error("Deleted row still stored after compaction.")
+	}
+}
+
+func TestYdbServer_Versions(t *testing.T) {
 	client := serverStartup()
-	putRowRecords(client, N)
+	defer serverCloseAndCleanup(client)
+	setMemTableLimit(tableName, 1000*testRowBytes)
+	table := testServer.tables[tableName]
+	table.dataLocker.Lock()
+	table.metadata.FamilyOptions = map[string]ydbserverrpc.ColumnFamilyOptions{"Name": {MaxVersions: 3}}
+	table.dataLocker.Unlock()
 
-	start := time.Now()
-	getRowRecords(client, N)
-	end := time.Now()
-	diff := end.Sub(start)
-	fmt.Printf("Test GetRow for %d times, take %v.\n", N, diff)
+	for _, ts := range []int64{10, 20, 30, 40} {
+		putRowAt(t, client, "audit", map[string]string{
+			"Name:First Name": "First" + strconv.FormatInt(ts, 10),
+			"Address:City":    "City" + strconv.FormatInt(ts, 10),
+		}, ts)
+	}
+	checkVersions := func(stage string, args ydbserverrpc.GetRowArgs, column string, want ...int64) {
+		args.TableName = tableName
+		args.RowKey = "audit"
+		versions := getVersions(t, client, &args)
+		cells := versions[column]
+		if len(cells) != len(want) {
+			t.Errorf("%s: wrong versions of %s %v, want %v", stage, column, cells, want)
+			return
+		}
+		for i, ts := range want {
+			if cells[i].Timestamp != ts || !strings.HasSuffix(string(cells[i].Value), strconv.FormatInt(ts, 10)) {
+				t.Errorf("%s: wrong versions of %s %v, want %v", stage, column, cells, want)
+			}
+		}
+	}
+	checkVersions("memtable", ydbserverrpc.GetRowArgs{MaxVersions: 10}, "Name:First Name", 40, 30, 20)
+	checkVersions("memtable", ydbserverrpc.GetRowArgs{MaxVersions: 10}, "Address:City", 40)
+	checkVersions("memtable", ydbserverrpc.GetRowArgs{MaxVersions: 2}, "Name:First Name", 40, 30)
+	checkVersions("range", ydbserverrpc.GetRowArgs{MaxVersions: 10, MinTimestamp: 20, MaxTimestamp: 40}, "Name:First Name", 30, 20)
+	if row := getRow(t, client, "audit"); row["Name:First Name"] != "First40" {
+		t.Errorf("Wrong latest value %v", row)
+	}
 
-	serverCloseAndCleanup(client)
+	// Versions of several segments are merged and trimmed on reads
+	table.dataLocker.Lock()
+	err := table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRowAt(t, client, "audit", map[string]string{"Name:First Name": "First50"}, 50)
+	checkVersions("merged", ydbserverrpc.GetRowArgs{MaxVersions: 10}, "Name:First Name", 50, 40, 30)
+
+	// Compaction keeps MaxVersions versions on disk
+	table.dataLocker.Lock()
+	err = table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactAll(t, table)
+	checkVersions("compacted", ydbserverrpc.GetRowArgs{MaxVersions: 10}, "Name:First Name", 50, 40, 30)
+	var names *segment
+	for _, seg := range table.snapshotSegments() {
+		if seg.meta.Family == "Name" {
+			names = seg
+		}
+	}
+	if v, ok, err := names.get("audit"); !ok || err != nil {
+		t.Fatalf("Row missing after compaction: %v", err)
+	} else if col, _ := decodeRow(v); len(col.Columns["Name:First Name"]) != 3 {
+		t.Errorf("Compaction kept %v", col.Columns["Name:First Name"])
+	}
+
+	// A delete hides the versions up to its timestamp
+	deleteColumnsArgs := &ydbserverrpc.DeleteColumnsArgs{
+		TableName:           tableName,
+		RowKey:              "audit",
+		QualifiedColumnKeys: []string{"Name:First Name"},
+		Timestamp:           45,
+	}
+	var deleteColumnsReply ydbserverrpc.DeleteColumnsReply
+	if err := client.Call("YDBServer.DeleteColumns", deleteColumnsArgs, &deleteColumnsReply); err != nil {
+		t.Fatal(err)
+	}
+	checkVersions("deleted", ydbserverrpc.GetRowArgs{MaxVersions: 10}, "Name:First Name", 50)
+	reopenTable(t, client, tableName)
+	checkVersions("recovered", ydbserverrpc.GetRowArgs{MaxVersions: 10}, "Name:First Name", 50)
+
+	var putRowReply ydbserverrpc.PutRowReply
+	if err := client.Call("YDBServer.PutRow", &ydbserverrpc.PutRowArgs{TableName: tableName, RowKey: "audit", Timestamp: -1}, &putRowReply); err != nil {
+		t.Fatal(err)
+	}
+	if putRowReply.Status != ydbserverrpc.InvalidArgument {
+		t.Errorf("Negative timestamp accepted with status %d.", putRowReply.Status)
+	}
+	createTableArgs := &ydbserverrpc.CreateTableArgs{
+		TableName:      "versions_invalid",
+		ColumnFamilies: []string{"Name"},
+		FamilyOptions:  map[string]ydbserverrpc.ColumnFamilyOptions{"Address": {MaxVersions: 2}},
+	}
+	var createTableReply ydbserverrpc.CreateTableReply
+	if err := client.Call("YDBServer.CreateTable", createTableArgs, &createTableReply); err != nil {
+		t.Fatal(err)
+	}
+	if createTableReply.Status != ydbserverrpc.InvalidArgument {
+		t.Errorf("Options of an undeclared family accepted with status %d.", createTableReply.Status)
+	}
 }
 
-func TestYdbServer_PutRow(t *testing.T) {
+func TestYdbServer_TTL(t *testing.T) {
 	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	setMemTableLimit(tableName, 1000*testRowBytes)
+	table := testServer.tables[tableName]
+	table.dataLocker.Lock()
+	table.metadata.FamilyOptions = map[string]ydbserverrpc.ColumnFamilyOptions{"Address": {TTL: time.Hour}}
+	table.dataLocker.Unlock()
+	flush := func() {
+		table.dataLocker.Lock()
+		err := table.flush(testServer)
+		table.dataLocker.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	putRowWithTTL := func(rowKey string) {
+		putRowArgs := &ydbserverrpc.PutRowArgs{
+			TableName:      tableName,
+			RowKey:         rowKey,
+			UpdatedColumns: map[string][]byte{"Name:First Name": []byte("First")},
+			TTL:            300 * time.Millisecond,
+		}
+		var putRowReply ydbserverrpc.PutRowReply
+		if err := client.Call("YDBServer.PutRow", putRowArgs, &putRowReply); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	start := time.Now()
-	putRowRecords(client, N)
-	end := time.Now()
-	diff := end.Sub(start)
-	fmt.Printf("Test PutRow for %d times, take %v.\n", N, diff)
+	// Flushed before it expires, so only compaction can remove it
+	putRowWithTTL("flushed")
+	flush()
+	putRowWithTTL("session")
 
-	serverCloseAndCleanup(client)
+	// The family TTL counts from the cell timestamp
+	old := time.Now().Add(-2 * time.Hour).UnixNano()
+	putRowAt(t, client, "old", map[string]string{"Name:First Name": "First", "Address:City": "City"}, old)
+	if row := getRow(t, client, "old"); len(row) != 1 || row["Name:First Name"] != "First" {
+		t.Errorf("Wrong row with expired family %v", row)
+	}
+	if row := getRow(t, client, "flushed"); len(row) != 1 {
+		t.Errorf("Live cell hidden %v", row)
+	}
+
+	// Per cell TTLs hide cells right after they expire
+	time.Sleep(400 * time.Millisecond)
+	for _, rowKey := range []string{"flushed", "session"} {
+		var getColumnByRowReply ydbserverrpc.GetColumnByRowReply
+		getColumnByRowArgs := &ydbserverrpc.GetColumnByRowArgs{TableName: tableName, RowKey: rowKey, QualifiedColumnKey: "Name:First Name"}
+		if err := client.Call("YDBServer.GetColumnByRow", getColumnByRowArgs, &getColumnByRowReply); err != nil {
+			t.Fatal(err)
+		}
+		if len(getColumnByRowReply.Value) != 0 {
+			t.Errorf("Expired cell of %s returned %q", rowKey, getColumnByRowReply.Value)
+		}
+	}
+	getRowsArgs := &ydbserverrpc.GetRowsArgs{TableName: tableName, StartRowKey: "a", EndRowKey: "z"}
+	var getRowsReply ydbserverrpc.GetRowsReply
+	if err := client.Call("YDBServer.GetRows", getRowsArgs, &getRowsReply); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := getRowsReply.Rows["flushed"]; ok {
+		t.Errorf("Expired row in range scan %v", getRowsReply.Rows)
+	}
+
+	flush()
+	if _, ok, _ := table.segments[len(table.segments)-1].get("session"); ok {
+		t.Error("Expired cell written by flush.")
+	}
+	compactAll(t, table)
+	if _, ok, _ := table.segments[0].get("flushed"); ok {
+		t.Error("Expired cell kept by compaction.")
+	}
+	v, ok, _ := table.segments[0].get("old")
+	if !ok {
+		t.Fatal("Live row dropped by compaction.")
+	}
+	if col, _ := decodeRow(v); len(col.Columns) != 1 {
+		t.Errorf("Expired family kept by compaction %v", col.Columns)
+	}
 }
 
-func TestYdbServer_GetRows(t *testing.T) {
+func TestYdbServer_WAL(t *testing.T) {
 	client := serverStartup()
-	putRowRecords(client, N)
+	defer serverCloseAndCleanup(client)
+	setMemTableLimit(tableName, 1000*testRowBytes)
+	closeTable := func() {
+		var closeTableReply ydbserverrpc.CloseTableReply
+		if err := client.Call("YDBServer.CloseTable", &ydbserverrpc.CloseTableArgs{TableName: tableName}, &closeTableReply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	openTable := func() {
+		var openReply ydbserverrpc.OpenTableReply
+		if err := client.Call("YDBServer.OpenTable", &ydbserverrpc.OpenTableArgs{TableName: tableName}, &openReply); err != nil {
+			t.Fatal(err)
+		}
+		setMemTableLimit(tableName, 1000*testRowBytes)
+	}
 
-	start := time.Now()
-	getRowsRecords(client, N)
-	end := time.Now()
-	diff := end.Sub(start)
+	putRow(t, client, "a|b\nc", map[string]string{"Name:First Name": "x|y\nz"})
+	putRow(t, client, "torn", map[string]string{"Name:First Name": "First"})
 
-	fmt.Printf("Test GetRows for %d times, take %v.\n", N, diff)
+	// A torn last record is cut off, the records before it survive
+	closeTable()
+	ids := walFileIDs(tableName)
+	walPath := tableWALName(tableName, ids[len(ids)-1])
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(walPath, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	openTable()
+	if row := getRow(t, client, "torn"); len(row) != 0 {
+		t.Errorf("Torn record replayed %v", row)
+	}
+	// Separators of the old text format are plain bytes now
+	if row := getRow(t, client, "a|b\nc"); row["Name:First Name"] != "x|y\nz" {
+		t.Errorf("Record before the torn one lost %v", row)
+	}
+	putRow(t, client, "after", map[string]string{"Name:First Name": "First"})
+	reopenTable(t, client, tableName)
+	if row := getRow(t, client, "after"); len(row) != 1 {
+		t.Errorf("Record after the cut lost %v", row)
+	}
 
-	serverCloseAndCleanup(client)
+	// Text WALs are replayed and rewritten in the binary format
+	closeTable()
+	legacyPath := tableLegacyWALName(tableName)
+	removeWALFiles(tableName, ^uint64(0))
+	legacy := "flushed|Name:First Name|Old\ncp\nlegacy|Name:First Name|Old|er\n"
+	if err := os.WriteFile(legacyPath, []byte(legacy), 0666); err != nil {
+		t.Fatal(err)
+	}
+	openTable()
+	if row := getRow(t, client, "legacy"); row["Name:First Name"] != "Old|er" {
+		t.Errorf("Wrong row of text WAL %v", row)
+	}
+	if row := getRow(t, client, "flushed"); len(row) != 0 {
+		t.Errorf("Row before the checkpoint of text WAL returned %v", row)
+	}
+	reopenTable(t, client, tableName)
+	if row := getRow(t, client, "legacy"); row["Name:First Name"] != "Old|er" {
+		t.Errorf("Wrong row of rewritten WAL %v", row)
+	}
+	if row := getRow(t, client, "flushed"); len(row) != 0 {
+		t.Errorf("Row before the checkpoint of rewritten WAL returned %v", row)
+	}
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Error("Text WAL was not rewritten.")
+	}
 }
 
-func TestYdbServer_GetColumnByRow(t *testing.T) {
+func TestYdbServer_WALRotation(t *testing.T) {
 	client := serverStartup()
-	putRowRecords(client, N)
+	defer serverCloseAndCleanup(client)
+	setMemTableLimit(tableName, 1000*testRowBytes)
+	table := testServer.tables[tableName]
+	table.dataLocker.Lock()
+	table.metadata.WALSegmentSize = 1024
+	table.closeWAL()
+	err := table.openWAL()
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	start := time.Now()
-	getColumnByRowRecords(client, N)
-	end := time.Now()
-	diff := end.Sub(start)
+	// The WAL moves to a new file at the size limit and replays across files
+	for i := 0; i < 200; i++ {
+		putRow(t, client, fmt.Sprintf("row%03d", i), map[string]string{"Name:First Name": "First"})
+	}
+	if n := len(walFileIDs(tableName)); n < 10 {
+		t.Errorf("WAL rotated into %d files only.", n)
+	}
+	reopenTable(t, client, tableName)
+	table = testServer.tables[tableName]
+	if n := table.data.len(); n != 200 {
+		t.Errorf("Recovered %d rows from rotated WAL, want 200.", n)
+	}
 
-	fmt.Printf("Test GetColumnByRow for %d times, take %v.\n", N, diff)
+	// A flush deletes the WAL files it made obsolete
+	table.dataLocker.Lock()
+	err = table.flush(testServer)
+	table.dataLocker.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putRow(t, client, "after", map[string]string{"Name:First Name": "First"})
+	if ids := walFileIDs(tableName); len(ids) != 1 {
+		t.Errorf("WAL files %v left after flush.", ids)
+	}
 
-	serverCloseAndCleanup(client)
+	// Recovery starts at the checkpoint and drops older files
+	stale := tableWALName(tableName, 0)
+	if err := os.WriteFile(stale, []byte{}, 0666); err != nil {
+		t.Fatal(err)
+	}
+	reopenTable(t, client, tableName)
+	table = testServer.tables[tableName]
+	if _, ok := table.data.get("after"); !ok || table.data.len() != 1 {
+		t.Errorf("Recovered %d rows after checkpoint, want only the last one.", table.data.len())
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("WAL file before the checkpoint not deleted.")
+	}
+	if row := getRow(t, client, "row100"); len(row) != 1 {
+		t.Errorf("Flushed row lost %v", row)
+	}
+
+	// The WAL file 5 of a table is named like the legacy WAL of the table
+	// "<table>.5", so names with a dot are rejected
+	for _, name := range []string{tableName + ".5", "dir/" + tableName, ""} {
+		var reply ydbserverrpc.CreateTableReply
+		if err := client.Call("YDBServer.CreateTable", &ydbserverrpc.CreateTableArgs{TableName: name, ColumnFamilies: []string{"Name"}}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status != ydbserverrpc.InvalidArgument {
+			t.Errorf("CreateTable of %q got status %d.", name, reply.Status)
+		}
+	}
+}
+
+// Point reads go straight to the record offset, so their cost stays flat as
+// the segment file grows.
+func BenchmarkYdbServer_GetRow_FileSize(b *testing.B) {
+	client := serverStartup()
+	defer serverCloseAndCleanup(client)
+	table := testServer.tables[tableName]
+
+	written := 0
+	for _, rows := range []int{1000, 10000, 100000} {
+		// Grow the table and compact it back into one file
+		batch := newMemTable()
+		for ; written < rows; written++ {
+			col := newYDBColumn()
+			col.put("Name:First Name", YDBCell{Value: []byte("First" + strconv.Itoa(written)), Timestamp: int64(written + 1)})
+			batch.set(fmt.Sprintf("row%06d", written), col)
+		}
+		table.dataLocker.Lock()
+		err := table.writeSegments(testServer, batch)
+		table.dataLocker.Unlock()
+		if err != nil {
+			b.Fatal(err)
+		}
+		compactAll(b, table)
+
+		b.Run(fmt.Sprintf("Rows%d", rows), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("row%06d", rand.Intn(rows))
+				table.dataLocker.RLock()
+				col, err := table.GetRowHelper(testServer, key, nil)
+				table.dataLocker.RUnlock()
+				if err != nil || len(col.Columns) != 1 {
+					b.Fatalf("Wrong row %s: %v %v", key, col, err)
+				}
+			}
+		})
+	}
 }
 
 // Multi clients concurrent Testing
@@ -79,9 +2573,7 @@ func TestYdbServer_GetRow_Multi_Clients(t *testing.T) {
 	clients := serverStartupWithClients(clientNumber)
 
 	start := time.Now()
-	for _, client := range clients {
-		go getRowRecords(client, N)
-	}
+	runClients(clients, getRowRecords)
 	end := time.Now()
 	diff := end.Sub(start)
 
@@ -97,9 +2589,7 @@ func TestYdbServer_PutRow_Multi_Clients(t *testing.T) {
 	clients := serverStartupWithClients(clientNumber)
 
 	start := time.Now()
-	for _, client := range clients {
-		go putRowRecords(client, N)
-	}
+	runClients(clients, putRowRecords)
 	end := time.Now()
 	diff := end.Sub(start)
 
@@ -115,9 +2605,7 @@ func TestYdbServer_GetRows_Multi_Clients(t *testing.T) {
 	clients := serverStartupWithClients(clientNumber)
 
 	start := time.Now()
-	for _, client := range clients {
-		go getRowsRecords(client, N)
-	}
+	runClients(clients, getRowsRecords)
 	end := time.Now()
 	diff := end.Sub(start)
 
@@ -132,9 +2620,7 @@ func TestYdbServer_GetColumnByRow_Multi_Clients(t *testing.T) {
 	clients := serverStartupWithClients(clientNumber)
 
 	start := time.Now()
-	for _, client := range clients {
-		go getColumnByRowRecords(client, N)
-	}
+	runClients(clients, getColumnByRowRecords)
 	end := time.Now()
 	diff := end.Sub(start)
 
@@ -146,55 +2632,139 @@ func TestYdbServer_GetColumnByRow_Multi_Clients(t *testing.T) {
 	}
 }
 
-func serverStartup() *rpc.Client {
-	port, err := freeport.GetFreePort()
-	if err != nil {
-		fmt.Println(err)
+func TestYdbServer_GroupCommit(t *testing.T) {
+	clients := serverStartupWithClients(clientNumber)
+	defer func() {
+		serverCloseAndCleanup(clients[0])
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	setMemTableLimit(tableName, 100000*testRowBytes)
+	table := testServer.tables[tableName]
+	setSyncPolicy := func(policy ydbserverrpc.SyncPolicy, interval time.Duration) *walWriter {
+		table.dataLocker.Lock()
+		defer table.dataLocker.Unlock()
+		table.metadata.WALSyncPolicy = policy
+		table.metadata.WALSyncInterval = interval
+		table.closeWAL()
+		if err := table.openWAL(); err != nil {
+			t.Fatal(err)
+		}
+		return table.wal
+	}
+	putRows := func(prefix string, perClient int) {
+		var wg sync.WaitGroup
+		for i, client := range clients {
+			wg.Add(1)
+			go func(i int, client *rpc.Client) {
+				defer wg.Done()
+				for j := 0; j < perClient; j++ {
+					putRow(t, client, fmt.Sprintf("%s%02d%03d", prefix, i, j), map[string]string{"Name:First Name": "First"})
+				}
+			}(i, client)
+		}
+		wg.Wait()
 	}
+	writes := uint64(clientNumber * 50)
 
-	NewYDBServer("", 1, port, 0)
-	fmt.Println("localhost:" + strconv.Itoa(port))
-	client, err := rpc.DialHTTP("tcp", "localhost:"+strconv.Itoa(port))
-	if err != nil {
-		fmt.Println(err)
+	// Records queued while a sync runs share the next one
+	wal := setSyncPolicy(ydbserverrpc.SyncGroup, 0)
+	putRows("group", 50)
+	if syncs := atomic.LoadUint64(&wal.syncs); syncs == 0 || syncs > writes {
+		t.Errorf("Group commit synced %d times for %d writes.", syncs, writes)
+	}
+	table.dataLocker.Lock()
+	before := atomic.LoadUint64(&wal.syncs)
+	commits := make([]*walCommit, 0, 200)
+	for i := 0; i < 200; i++ {
+		rec := walRecord{op: walOpPut, rowKey: "burst", timestamp: int64(i + 1), keys: []string{"Name:First Name"}, values: [][]byte{[]byte("First")}}
+		commits = append(commits, wal.append([]walRecord{rec}))
+	}
+	table.dataLocker.Unlock()
+	for _, c := range commits {
+		if err := c.wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if syncs := atomic.LoadUint64(&wal.syncs) - before; syncs >= 200 {
+		t.Errorf("Group commit synced %d times for a burst of 200 writes.", syncs)
 	}
 
-	schema := make([]string, 0)
-	schema = append(schema, "Name")
-	schema = append(schema, "Address")
-	createTableArgs := &ydbserverrpc.CreateTableArgs{
-		TableName:      tableName,
-		ColumnFamilies: schema,
+	wal = setSyncPolicy(ydbserverrpc.SyncEveryWrite, 0)
+	putRows("every", 50)
+	if syncs := atomic.LoadUint64(&wal.syncs); syncs != writes {
+		t.Errorf("Per write policy synced %d times for %d writes.", syncs, writes)
 	}
-	var createTableReply ydbserverrpc.CreateTableReply
-	if err := client.Call("YDBServer.CreateTable", createTableArgs, &createTableReply); err != nil {
-		panic(err)
+
+	wal = setSyncPolicy(ydbserverrpc.SyncInterval, 20*time.Millisecond)
+	putRows("interval", 50)
+	time.Sleep(100 * time.Millisecond)
+	if syncs := atomic.LoadUint64(&wal.syncs); syncs == 0 || syncs >= writes {
+		t.Errorf("Interval policy synced %d times for %d writes.", syncs, writes)
 	}
-	openArgs := &ydbserverrpc.OpenTableArgs{
-		TableName: tableName,
+
+	// Every acknowledged write is in the WAL
+	reopenTable(t, clients[0], tableName)
+	for _, prefix := range []string{"group", "every", "interval"} {
+		for i := 0; i < clientNumber; i++ {
+			if row := getRow(t, clients[0], fmt.Sprintf("%s%02d%03d", prefix, i, 49)); len(row) != 1 {
+				t.Errorf("Write of %s client %d lost.", prefix, i)
+			}
+		}
 	}
-	var openReply ydbserverrpc.OpenTableReply
-	if err := client.Call("YDBServer.OpenTable", openArgs, &openReply); err != nil {
-		fmt.Println(err)
+	if n := testServer.tables[tableName].data.len(); n != 3*int(writes)+1 {
+		t.Errorf("Recovered %d rows, want %d.", n, 3*writes+1)
 	}
+}
+
+// startTestServer starts the server shared by all tests. A process can run one
+// server only, as the server keeps the index db open and bbolt locks it.
+func startTestServer() string {
+	testServerOnce.Do(func() {
+		port, err := freeport.GetFreePort()
+		if err != nil {
+			panic(err)
+		}
 
-	return client
+		server, err := NewYDBServer("", 1, port, 0)
+		if err != nil {
+			panic(err)
+		}
+		testServer = server.(*ydbServer)
+		testServerAddr = "localhost:" + strconv.Itoa(port)
+		fmt.Println(testServerAddr)
+	})
+	return testServerAddr
 }
 
-func serverStartupWithClients(clientNum int) []*rpc.Client {
-	port, err := freeport.GetFreePort()
-	if err != nil {
-		fmt.Println(err)
+// runClients calls f with N for every client at once and waits for all of
+// them, so that no call reaches the shared server after the test.
+func runClients(clients []*rpc.Client, f func(*rpc.Client, int)) {
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *rpc.Client) {
+			defer wg.Done()
+			f(client, N)
+		}(client)
 	}
+	wg.Wait()
+}
+
+func serverStartup() *rpc.Client {
+	return serverStartupWithClients(1)[0]
+}
 
-	NewYDBServer("", 1, port, 0)
-	fmt.Println("localhost:" + strconv.Itoa(port))
+func serverStartupWithClients(clientNum int) []*rpc.Client {
+	addr := startTestServer()
 
+	var err error
 	clients := make([]*rpc.Client, clientNum)
 	for i := 0; i < clientNum; i++ {
-		clients[i], err = rpc.DialHTTP("tcp", "localhost:"+strconv.Itoa(port))
+		clients[i], err = rpc.DialHTTP("tcp", addr)
 		if err != nil {
-			fmt.Println(err)
+			panic(err)
 		}
 	}
 
@@ -238,6 +2808,118 @@ func serverCloseAndCleanup(client *rpc.Client) {
 	}
 }
 
+// testRowBytes approximates the memtable size of the small rows of the tests.
+const testRowBytes = 128
+
+func setMemTableLimit(name string, limit int64) {
+	table := testServer.tables[name]
+	table.dataLocker.Lock()
+	table.metadata.MemTableLimit = limit
+	table.dataLocker.Unlock()
+}
+
+// compactAll runs a full compaction through the background compactor and
+// waits until a single segment is left.
+func compactAll(tb testing.TB, table *ydbTable) {
+	progress := func() ydbserverrpc.CompactionProgress {
+		table.configLocker.Lock()
+		defer table.configLocker.Unlock()
+		return table.compactionProgress()
+	}
+	table.configLocker.Lock()
+	table.requestCompaction()
+	table.configLocker.Unlock()
+	for i := 0; i < 500; i++ {
+		if !progress().Running && table.pickCompaction(true) == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	tb.Fatalf("Compaction did not finish: %+v", progress())
+}
+
+func reopenTable(t *testing.T, client *rpc.Client, name string) {
+	var closeTableReply ydbserverrpc.CloseTableReply
+	if err := client.Call("YDBServer.CloseTable", &ydbserverrpc.CloseTableArgs{TableName: name}, &closeTableReply); err != nil {
+		t.Fatal(err)
+	}
+	var openReply ydbserverrpc.OpenTableReply
+	if err := client.Call("YDBServer.OpenTable", &ydbserverrpc.OpenTableArgs{TableName: name}, &openReply); err != nil {
+		t.Fatal(err)
+	}
+	if openReply.Status != ydbserverrpc.OK {
+		t.Fatalf("Reopen table failed with status %d.", openReply.Status)
+	}
+}
+
+func putRow(t *testing.T, client *rpc.Client, rowKey string, columns map[string]string) {
+	putRowArgs := &ydbserverrpc.PutRowArgs{
+		TableName:      tableName,
+		RowKey:         rowKey,
+		UpdatedColumns: byteValues(columns),
+	}
+	var putRowReply ydbserverrpc.PutRowReply
+	if err := client.Call("YDBServer.PutRow", putRowArgs, &putRowReply); err != nil {
+		t.Fatal(err)
+	}
+	if putRowReply.Status != ydbserverrpc.OK {
+		t.Fatalf("PutRow of %s got status %d.", rowKey, putRowReply.Status)
+	}
+}
+
+func putRowAt(t *testing.T, client *rpc.Client, rowKey string, columns map[string]string, timestamp int64) {
+	putRowArgs := &ydbserverrpc.PutRowArgs{
+		TableName:      tableName,
+		RowKey:         rowKey,
+		UpdatedColumns: byteValues(columns),
+		Timestamp:      timestamp,
+	}
+	var putRowReply ydbserverrpc.PutRowReply
+	if err := client.Call("YDBServer.PutRow", putRowArgs, &putRowReply); err != nil {
+		t.Fatal(err)
+	}
+	if putRowReply.Status != ydbserverrpc.OK {
+		t.Fatalf("PutRow of %s got status %d.", rowKey, putRowReply.Status)
+	}
+}
+
+func byteValues(columns map[string]string) map[string][]byte {
+	values := make(map[string][]byte)
+	for key, value := range columns {
+		values[key] = []byte(value)
+	}
+	return values
+}
+
+func getVersions(t *testing.T, client *rpc.Client, args *ydbserverrpc.GetRowArgs) map[string][]YDBCell {
+	var getRowReply ydbserverrpc.GetRowReply
+	if err := client.Call("YDBServer.GetRow", args, &getRowReply); err != nil {
+		t.Fatal(err)
+	}
+	versions := make(map[string][]YDBCell)
+	for _, cell := range getRowReply.Cells {
+		key := cell.Family + ":" + cell.Qualifier
+		versions[key] = append(versions[key], YDBCell{Value: cell.Value, Timestamp: cell.Timestamp})
+	}
+	return versions
+}
+
+func getRow(t *testing.T, client *rpc.Client, rowKey string) map[string]string {
+	getRowArgs := &ydbserverrpc.GetRowArgs{
+		TableName: tableName,
+		RowKey:    rowKey,
+	}
+	var getRowReply ydbserverrpc.GetRowReply
+	if err := client.Call("YDBServer.GetRow", getRowArgs, &getRowReply); err != nil {
+		t.Fatal(err)
+	}
+	row := make(map[string]string)
+	if err := json.Unmarshal([]byte(getRowReply.Row), &row); err != nil {
+		t.Fatal(err)
+	}
+	return row
+}
+
 func getRowRecords(client *rpc.Client, N int) {
 	for i := 0; i < N; i++ {
 		getRowArgs := &ydbserverrpc.GetRowArgs{
@@ -253,9 +2935,9 @@ func getRowRecords(client *rpc.Client, N int) {
 
 func putRowRecords(client *rpc.Client, N int) {
 	for i := 0; i < N; i++ {
-		columns := make(map[string]string)
-		columns["Name:First Name"] = "First"
-		columns["Name:Last Name"] = "Last"
+		columns := make(map[string][]byte)
+		columns["Name:First Name"] = []byte("First")
+		columns["Name:Last Name"] = []byte("Last")
 		putRowArgs := &ydbserverrpc.PutRowArgs{
 			TableName:      tableName,
 			RowKey:         strconv.Itoa(rand.Intn(NRange)),
@@ -0,0 +1,602 @@
+package ydb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/boylee1111/ydb/ydbserverrpc"
+)
+
+// A segment is an immutable file of rows sorted by row key, written by one
+// flush (or by compaction). Every column family is stored in segments of its
+// own, so reads of some families leave the files of the others alone; the
+// segments of older tables hold every family. The layout is
+//
+//	data block | data block | ... | bloom filter | block index | footer
+//
+// A data block is a codec byte followed by a run of entries (uvarint key
+// length, key, uvarint value length, value), compressed by the codec. The
+// block index has one entry per data block (uvarint last
+// key length, last key, uvarint offset, uvarint length) so a point read only
+// has to load the block that may hold the key. The bloom filter covers every
+// row key of the segment. The fixed size footer records where the filter and
+// the block index are, and ends with a magic number that carries the format
+// version.
+
+const (
+	segmentBlockSize  = 4 * 1024           // Target size of one data block
+	segmentFooterSize = 40                 // Filter offset, filter length, index offset, index length, magic
+	segmentMagic      = 0x7964627373743030 // "ydbsst0" followed by the version digit
+	segmentVersion    = 5                  // Version of the segments
+)
+
+var errCorruptSegment = errors.New("Corrupt segment file.")
+
+type blockHandle struct {
+	lastKey string // Last row key stored in the block
+	offset  int64  // Block position in file
+	length  int64  // Block length in bytes
+}
+
+// segmentMeta describes a segment in the table manifest.
+type segmentMeta struct {
+	ID     uint64 // File number, unique in the table
+	Seq    uint64 // Ordering key, larger is newer
+	Size   int64  // File size in bytes
+	Rows   int    // Number of rows
+	MinKey string // Smallest row key
+	MaxKey string // Largest row key
+	Family string // Column family of the rows, "" for segments holding every family
+}
+
+// manifestMeta is segmentMeta as the manifest stores it. Row keys are any
+// bytes, so they are kept as []byte, which JSON writes as base64.
+type manifestMeta struct {
+	ID     uint64
+	Seq    uint64
+	Size   int64
+	Rows   int
+	MinKey []byte
+	MaxKey []byte
+	Family string `json:",omitempty"`
+}
+
+func (meta segmentMeta) MarshalJSON() ([]byte, error) {
+	return json.Marshal(manifestMeta{
+		ID:     meta.ID,
+		Seq:    meta.Seq,
+		Size:   meta.Size,
+		Rows:   meta.Rows,
+		MinKey: []byte(meta.MinKey),
+		MaxKey: []byte(meta.MaxKey),
+		Family: meta.Family,
+	})
+}
+
+func (meta *segmentMeta) UnmarshalJSON(data []byte) error {
+	var stored manifestMeta
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	*meta = segmentMeta{ID: stored.ID, Seq: stored.Seq, Size: stored.Size, Rows: stored.Rows, MinKey: string(stored.MinKey), MaxKey: string(stored.MaxKey), Family: stored.Family}
+	return nil
+}
+
+type segment struct {
+	meta    segmentMeta
+	path    string
+	file    *os.File
+	index   []blockHandle
+	filter  *bloomFilter
+	cache   *blockCache // Shared by all tables of the server
+	refs    int32       // References of the table and of open scanners
+	retired int32       // Replaced by compaction, the file goes with the last reference
+}
+
+type segmentWriter struct {
+	path          string
+	file          *os.File
+	writer        *bufio.Writer
+	offset        int64         // Bytes written so far
+	block         *bytes.Buffer // Current data block
+	index         []blockHandle
+	meta          segmentMeta
+	lastKey       string
+	keyHashes     []uint64                 // Hashes of all row keys, for the bloom filter
+	falsePositive float64                  // Bloom filter false positive rate
+	compression   ydbserverrpc.Compression // Codec of the data blocks
+}
+
+func newSegmentWriter(path string, meta segmentMeta, falsePositive float64, compression ydbserverrpc.Compression) (*segmentWriter, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentWriter{
+		path:   path,
+		file:   f,
+		writer: bufio.NewWriter(f),
+		block:  new(bytes.Buffer),
+		meta:   meta,
+
+		falsePositive: falsePositive,
+		compression:   compression,
+	}, nil
+}
+
+// add appends a row and returns where its record is in the file, an unknown
+// offset inside compressed blocks. Keys must be added in increasing order.
+func (w *segmentWriter) add(key string, value []byte) (rowLocation, error) {
+	loc := rowLocation{
+		Segment: w.meta.ID,
+		Offset:  w.offset + 1 + int64(w.block.Len()), // After the codec byte
+	}
+	if w.meta.Rows > 0 && key <= w.lastKey {
+		return loc, errors.New("Segment keys out of order.")
+	}
+	if w.meta.Rows == 0 {
+		w.meta.MinKey = key
+	}
+	putUvarint(w.block, uint64(len(key)))
+	w.block.WriteString(key)
+	putUvarint(w.block, uint64(len(value)))
+	w.block.Write(value)
+	loc.Length = w.offset + 1 + int64(w.block.Len()) - loc.Offset
+	if w.compression != ydbserverrpc.CompressionNone {
+		loc.Offset = -1
+	}
+	w.lastKey = key
+	w.keyHashes = append(w.keyHashes, bloomHash(key))
+	w.meta.Rows++
+
+	if w.block.Len() >= segmentBlockSize {
+		return loc, w.finishBlock()
+	}
+	return loc, nil
+}
+
+func (w *segmentWriter) finishBlock() error {
+	if w.block.Len() == 0 {
+		return nil
+	}
+	data, err := compressBlock(w.compression, w.block.Bytes())
+	if err != nil {
+		return err
+	}
+	n, err := w.writer.Write(data)
+	if err != nil {
+		return err
+	}
+	w.index = append(w.index, blockHandle{
+		lastKey: w.lastKey,
+		offset:  w.offset,
+		length:  int64(n),
+	})
+	w.offset += int64(n)
+	w.block.Reset()
+	return nil
+}
+
+// finish writes the bloom filter, block index and footer, syncs and closes
+// the file.
+func (w *segmentWriter) finish() (segmentMeta, error) {
+	if err := w.finishBlock(); err != nil {
+		return w.meta, err
+	}
+
+	filter := newBloomFilter(len(w.keyHashes), w.falsePositive)
+	for _, h := range w.keyHashes {
+		filter.addHash(h)
+	}
+	filterBlock := filter.encode()
+	filterOffset := w.offset
+	if _, err := w.writer.Write(filterBlock); err != nil {
+		return w.meta, err
+	}
+	w.offset += int64(len(filterBlock))
+
+	index := new(bytes.Buffer)
+	for _, handle := range w.index {
+		putUvarint(index, uint64(len(handle.lastKey)))
+		index.WriteString(handle.lastKey)
+		putUvarint(index, uint64(handle.offset))
+		putUvarint(index, uint64(handle.length))
+	}
+	footer := make([]byte, segmentFooterSize)
+	binary.BigEndian.PutUint64(footer[0:], uint64(filterOffset))
+	binary.BigEndian.PutUint64(footer[8:], uint64(len(filterBlock)))
+	binary.BigEndian.PutUint64(footer[16:], uint64(w.offset))
+	binary.BigEndian.PutUint64(footer[24:], uint64(index.Len()))
+	binary.BigEndian.PutUint64(footer[32:], segmentMagic+segmentVersion)
+
+	if _, err := w.writer.Write(index.Bytes()); err != nil {
+		return w.meta, err
+	}
+	if _, err := w.writer.Write(footer); err != nil {
+		return w.meta, err
+	}
+	if err := w.writer.Flush(); err != nil {
+		return w.meta, err
+	}
+	if err := w.file.Sync(); err != nil {
+		return w.meta, err
+	}
+	w.meta.MaxKey = w.lastKey
+	w.meta.Size = w.offset + int64(index.Len()) + segmentFooterSize
+	return w.meta, w.file.Close()
+}
+
+// abort drops a partially written segment.
+func (w *segmentWriter) abort() {
+	w.file.Close()
+	os.Remove(w.path)
+}
+
+func openSegment(path string, meta segmentMeta, cache *blockCache) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{
+		meta:  meta,
+		path:  path,
+		file:  f,
+		cache: cache,
+		refs:  1,
+	}
+	if err := seg.loadIndex(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return seg, nil
+}
+
+// loadIndex reads the footer, the block index and the bloom filter.
+func (seg *segment) loadIndex() error {
+	info, err := seg.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < segmentFooterSize {
+		return errCorruptSegment
+	}
+	footer := make([]byte, segmentFooterSize)
+	if _, err := seg.file.ReadAt(footer, info.Size()-segmentFooterSize); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(footer[32:]) != segmentMagic+segmentVersion {
+		return errCorruptSegment
+	}
+	filterOffset := int64(binary.BigEndian.Uint64(footer[0:]))
+	filterLength := int64(binary.BigEndian.Uint64(footer[8:]))
+	indexOffset := int64(binary.BigEndian.Uint64(footer[16:]))
+	indexLength := int64(binary.BigEndian.Uint64(footer[24:]))
+	if filterOffset+filterLength != indexOffset || indexOffset+indexLength+segmentFooterSize != info.Size() {
+		return errCorruptSegment
+	}
+	filter := make([]byte, filterLength)
+	if _, err := seg.file.ReadAt(filter, filterOffset); err != nil {
+		return err
+	}
+	if seg.filter, err = decodeBloomFilter(filter); err != nil {
+		return err
+	}
+
+	buf := make([]byte, indexLength)
+	if _, err := seg.file.ReadAt(buf, indexOffset); err != nil {
+		return err
+	}
+	reader := bytes.NewReader(buf)
+	for reader.Len() > 0 {
+		key, err := readBytes(reader)
+		if err != nil {
+			return err
+		}
+		offset, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return errCorruptSegment
+		}
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return errCorruptSegment
+		}
+		seg.index = append(seg.index, blockHandle{
+			lastKey: string(key),
+			offset:  int64(offset),
+			length:  int64(length),
+		})
+	}
+	return nil
+}
+
+func (seg *segment) close() error {
+	return seg.file.Close()
+}
+
+// acquire adds a reference that keeps the segment file open.
+func (seg *segment) acquire() {
+	atomic.AddInt32(&seg.refs, 1)
+}
+
+// release drops a reference. The last one closes the file and deletes it
+// when the segment was retired.
+func (seg *segment) release() {
+	if atomic.AddInt32(&seg.refs, -1) > 0 {
+		return
+	}
+	seg.close()
+	if atomic.LoadInt32(&seg.retired) != 0 {
+		os.Remove(seg.path)
+		seg.cache.invalidate(seg.path)
+	}
+}
+
+// retire drops the reference of the table to a segment replaced by
+// compaction.
+func (seg *segment) retire() {
+	atomic.StoreInt32(&seg.retired, 1)
+	seg.release()
+}
+
+// findBlock returns the first block that may contain key.
+func (seg *segment) findBlock(key string) int {
+	return sort.Search(len(seg.index), func(i int) bool {
+		return seg.index[i].lastKey >= key
+	})
+}
+
+// readBlock returns the entries of block i, decompressed and cached.
+func (seg *segment) readBlock(i int) ([]byte, error) {
+	handle := seg.index[i]
+	key := blockCacheKey{offset: handle.offset, length: handle.length}
+	if block, ok := seg.cache.get(seg.path, key); ok {
+		return block, nil
+	}
+	data := make([]byte, handle.length)
+	if _, err := seg.file.ReadAt(data, handle.offset); err != nil {
+		return nil, err
+	}
+	block, err := decompressBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	seg.cache.put(seg.path, key, block)
+	return block, nil
+}
+
+// readAt reads length bytes at offset through the block cache.
+func (seg *segment) readAt(offset int64, length int64) ([]byte, error) {
+	key := blockCacheKey{offset: offset, length: length}
+	if buf, ok := seg.cache.get(seg.path, key); ok {
+		return buf, nil
+	}
+	buf := make([]byte, length)
+	if _, err := seg.file.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	seg.cache.put(seg.path, key, buf)
+	return buf, nil
+}
+
+// holds tells whether the segment may store columns of set.
+func (seg *segment) holds(set columnSet) bool {
+	return seg.meta.Family == "" || set.hasFamily(seg.meta.Family)
+}
+
+// mayContain tells whether key can be in the segment without touching disk.
+func (seg *segment) mayContain(key string) bool {
+	if key < seg.meta.MinKey || key > seg.meta.MaxKey {
+		return false
+	}
+	return seg.filter.mayContain(key)
+}
+
+// get returns the value stored for key, seeking straight to its block.
+func (seg *segment) get(key string) ([]byte, bool, error) {
+	if !seg.mayContain(key) {
+		return nil, false, nil
+	}
+	i := seg.findBlock(key)
+	if i == len(seg.index) {
+		return nil, false, nil
+	}
+	block, err := seg.readBlock(i)
+	if err != nil {
+		return nil, false, err
+	}
+	reader := bytes.NewReader(block)
+	for reader.Len() > 0 {
+		k, v, err := readEntry(reader)
+		if err != nil {
+			return nil, false, err
+		}
+		if string(k) == key {
+			return v, true, nil
+		}
+		if string(k) > key {
+			break
+		}
+	}
+	return nil, false, nil
+}
+
+// readRecord reads the record at loc with a single read and checks that it
+// belongs to key. Records in compressed blocks fall back to the block index.
+func (seg *segment) readRecord(key string, loc rowLocation) ([]byte, bool, error) {
+	if loc.Offset < 0 {
+		return seg.get(key)
+	}
+	buf, err := seg.readAt(loc.Offset, loc.Length)
+	if err != nil {
+		return nil, false, err
+	}
+	k, v, err := readEntry(bytes.NewReader(buf))
+	if err != nil {
+		return nil, false, err
+	}
+	if string(k) != key {
+		return nil, false, errCorruptSegment
+	}
+	return v, true, nil
+}
+
+// segmentIterator streams the rows of a segment in key order, one block at a
+// time.
+type segmentIterator struct {
+	seg      *segment
+	block    int           // Index of the loaded block
+	reader   *bytes.Reader // Remaining entries in the loaded block
+	reverse  bool          // Walking towards smaller keys
+	entries  []blockEntry  // Entries of the loaded block in reverse
+	pos      int           // Entries left before the current one in reverse
+	curKey   string
+	curValue []byte
+	lastErr  error
+	ok       bool
+}
+
+func (seg *segment) iterator() *segmentIterator {
+	return &segmentIterator{seg: seg, block: -1}
+}
+
+// blockEntry is a row record of a data block.
+type blockEntry struct {
+	key   string
+	value []byte
+}
+
+// seek positions the iterator at the first row with key >= start.
+func (it *segmentIterator) seek(start string) {
+	it.reverse = false
+	it.block = it.seg.findBlock(start) - 1
+	it.reader = nil
+	it.next()
+	for it.ok && it.curKey < start {
+		it.next()
+	}
+}
+
+// seekReverse positions the iterator at the last row with key <= end, or at
+// the last row when end is empty. Later calls to next move backwards.
+func (it *segmentIterator) seekReverse(end string) {
+	it.reverse = true
+	it.block = len(it.seg.index)
+	if end != "" && it.seg.findBlock(end) < it.block {
+		it.block = it.seg.findBlock(end) + 1
+	}
+	it.pos = 0
+	it.next()
+	for it.ok && end != "" && it.curKey > end {
+		it.next()
+	}
+}
+
+func (it *segmentIterator) next() {
+	if it.reverse {
+		it.prev()
+		return
+	}
+	it.ok = false
+	for it.reader == nil || it.reader.Len() == 0 {
+		it.block++
+		if it.block >= len(it.seg.index) {
+			return
+		}
+		block, err := it.seg.readBlock(it.block)
+		if err != nil {
+			it.lastErr = err
+			return
+		}
+		it.reader = bytes.NewReader(block)
+	}
+	k, v, err := readEntry(it.reader)
+	if err != nil {
+		it.lastErr = err
+		return
+	}
+	it.curKey, it.curValue, it.ok = string(k), v, true
+}
+
+// prev moves to the row before the current one, loading the whole previous
+// block when the current one is used up.
+func (it *segmentIterator) prev() {
+	it.ok = false
+	for it.pos == 0 {
+		it.block--
+		if it.block < 0 {
+			return
+		}
+		block, err := it.seg.readBlock(it.block)
+		if err != nil {
+			it.lastErr = err
+			return
+		}
+		it.entries = it.entries[:0]
+		reader := bytes.NewReader(block)
+		for reader.Len() > 0 {
+			k, v, err := readEntry(reader)
+			if err != nil {
+				it.lastErr = err
+				return
+			}
+			it.entries = append(it.entries, blockEntry{key: string(k), value: v})
+		}
+		it.pos = len(it.entries)
+	}
+	it.pos--
+	entry := it.entries[it.pos]
+	it.curKey, it.curValue, it.ok = entry.key, entry.value, true
+}
+
+func (it *segmentIterator) valid() bool {
+	return it.ok
+}
+
+func (it *segmentIterator) key() string {
+	return it.curKey
+}
+
+func (it *segmentIterator) row() (YDBColumn, error) {
+	return decodeRow(it.curValue)
+}
+
+func (it *segmentIterator) err() error {
+	return it.lastErr
+}
+
+func putUvarint(buf *bytes.Buffer, x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	buf.Write(tmp[:n])
+}
+
+func readBytes(reader *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(reader)
+	if err != nil || n > uint64(reader.Len()) {
+		return nil, errCorruptSegment
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, errCorruptSegment
+	}
+	return buf, nil
+}
+
+func readEntry(reader *bytes.Reader) ([]byte, []byte, error) {
+	k, err := readBytes(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := readBytes(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, v, nil
+}
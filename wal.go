@@ -0,0 +1,685 @@
+package ydb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boylee1111/ydb/ydbserverrpc"
+	"go.etcd.io/bbolt"
+)
+
+// The WAL starts with a magic number, followed by records framed as
+//
+//	crc32 | length | sequence number | record
+//
+// The CRC (Castagnoli) covers the sequence number and the record, the length
+// counts both. A record is an operation byte, the row key, the timestamp, the
+// expiry of put cells, the delete kind and a count of column keys, each
+// followed by its value for puts. Strings are uvarint length prefixed,
+// numbers are varints.
+//
+// The WAL of a table is a series of numbered files. A flush moves the WAL to
+// a new file and, once the memtable is in a segment, records that file as the
+// checkpoint in the index db and deletes the files before it. Recovery only
+// replays the files from the checkpoint on.
+//
+// The first version wrote a single text WAL with one "<row key>|<column
+// key>|<value>" line per put and a "cp" line at each flush. It is replayed
+// and rewritten as a numbered file when the table is opened.
+
+const (
+	walMagic       = 0x79646277616c3031 // "ydbwal01"
+	walHeaderSize  = 8                  // Magic
+	walFrameHeader = 8                  // CRC, length
+	walMaxRecord   = 64 * 1024 * 1024   // Larger lengths can only come from corruption
+
+	walQueueSize           = 1024                   // Commits queued for the writer
+	walMaxBatch            = 1024                   // Commits written with one sync
+	defaultWALSyncInterval = 100 * time.Millisecond // Sync period of SyncInterval
+	defaultWALSegmentSize  = 16 * 1024 * 1024       // Size at which the WAL moves to a new file
+)
+
+var walCheckpointKey = []byte("walCheckpoint") // First WAL file that is not flushed
+
+// WAL operations.
+const (
+	walOpPut    byte = 1
+	walOpDelete byte = 2
+)
+
+var (
+	walCRCTable    = crc32.MakeTable(crc32.Castagnoli)
+	errWALHeader   = errors.New("Not a WAL file.")
+	errCorruptWAL  = errors.New("Corrupt WAL record.")
+	errTruncateWAL = errors.New("Truncated WAL record.")
+)
+
+// walRecord is one logged mutation of a row.
+type walRecord struct {
+	seq       uint64
+	op        byte
+	rowKey    string
+	timestamp int64
+	expireAt  int64    // Expiry of put cells, 0 for never
+	kind      string   // Scope of a delete
+	keys      []string // Put columns or delete targets
+	values    [][]byte // Put values, parallel to keys
+}
+
+func (rec *walRecord) encode() []byte {
+	data := new(bytes.Buffer)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], rec.seq)
+	data.Write(seq[:])
+	data.WriteByte(rec.op)
+	putString(data, rec.rowKey)
+	putVarint(data, rec.timestamp)
+	putVarint(data, rec.expireAt)
+	putString(data, rec.kind)
+	putUvarint(data, uint64(len(rec.keys)))
+	for i, key := range rec.keys {
+		putString(data, key)
+		if rec.op == walOpPut {
+			putBytes(data, rec.values[i])
+		}
+	}
+
+	frame := make([]byte, walFrameHeader, walFrameHeader+data.Len())
+	binary.BigEndian.PutUint32(frame[0:], crc32.Checksum(data.Bytes(), walCRCTable))
+	binary.BigEndian.PutUint32(frame[4:], uint32(data.Len()))
+	return append(frame, data.Bytes()...)
+}
+
+func decodeWALRecord(data []byte) (walRecord, error) {
+	var rec walRecord
+	if len(data) < 9 {
+		return rec, errCorruptWAL
+	}
+	rec.seq = binary.BigEndian.Uint64(data)
+	rec.op = data[8]
+	reader := bytes.NewReader(data[9:])
+	var err error
+	if rec.rowKey, err = readString(reader); err != nil {
+		return rec, err
+	}
+	if rec.timestamp, err = binary.ReadVarint(reader); err != nil {
+		return rec, err
+	}
+	if rec.expireAt, err = binary.ReadVarint(reader); err != nil {
+		return rec, err
+	}
+	if rec.kind, err = readString(reader); err != nil {
+		return rec, err
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return rec, err
+	}
+	if count > uint64(reader.Len()) {
+		return rec, errCorruptWAL
+	}
+	for i := uint64(0); i < count; i++ {
+		key, err := readString(reader)
+		if err != nil {
+			return rec, err
+		}
+		rec.keys = append(rec.keys, key)
+		if rec.op == walOpPut {
+			value, err := readBytes(reader)
+			if err != nil {
+				return rec, err
+			}
+			rec.values = append(rec.values, value)
+		}
+	}
+	return rec, nil
+}
+
+// readWAL calls apply for every record of a binary WAL file in order. Records
+// must be numbered after lastSeq. A torn or corrupt tail is reported and cut
+// off. It returns the sequence number of the last good record.
+func readWAL(path string, lastSeq uint64, apply func(walRecord)) (uint64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	header := make([]byte, walHeaderSize)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return lastSeq, nil
+		}
+		if bytes.HasPrefix(header[:n], []byte("ydbwal")) {
+			return lastSeq, f.Truncate(0)
+		}
+		return lastSeq, errWALHeader
+	}
+	if binary.BigEndian.Uint64(header) != walMagic {
+		return lastSeq, errWALHeader
+	}
+
+	offset := int64(walHeaderSize)
+	for {
+		data, err := readWALFrame(reader)
+		if err == io.EOF {
+			return lastSeq, nil
+		}
+		var rec walRecord
+		if err == nil {
+			if rec, err = decodeWALRecord(data); err != nil {
+				err = errCorruptWAL
+			}
+		}
+		if err == nil && rec.seq <= lastSeq {
+			err = errCorruptWAL
+		}
+		if err != nil {
+			fmt.Println("WAL "+path+": "+err.Error()+" Cut off at offset", offset)
+			return lastSeq, f.Truncate(offset)
+		}
+		apply(rec)
+		lastSeq = rec.seq
+		offset += int64(walFrameHeader + len(data))
+	}
+}
+
+func readWALFrame(reader *bufio.Reader) ([]byte, error) {
+	header := make([]byte, walFrameHeader)
+	if n, err := io.ReadFull(reader, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errTruncateWAL
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > walMaxRecord {
+		return nil, errCorruptWAL
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, errTruncateWAL
+	}
+	if crc32.Checksum(data, walCRCTable) != binary.BigEndian.Uint32(header) {
+		return nil, errCorruptWAL
+	}
+	return data, nil
+}
+
+// walWriter appends records to the WAL of a table from a single goroutine.
+// Records are queued in the order they are applied to the memtable. With the
+// SyncGroup policy the records queued while a sync runs are written and synced
+// together by the next one. The WAL moves to a new file once the current one
+// reaches the segment size, and on every flush.
+type walWriter struct {
+	tableName   string
+	file        *os.File // File being written, owned by the writer goroutine
+	seq         uint64   // Sequence number of the last queued record, guarded by the table lock
+	fileID      uint64   // File the next queued record goes to, guarded by the table lock
+	fileSize    int64    // Bytes queued for that file, guarded by the table lock
+	segmentSize int64    // Size at which the WAL moves to a new file
+	policy      ydbserverrpc.SyncPolicy
+	interval    time.Duration // Sync period of SyncInterval
+	queue       chan *walCommit
+	stop        chan struct{}
+	done        *sync.WaitGroup
+	syncs       uint64 // Syncs done so far, read atomically
+	err         error  // First failed write, every later commit fails with it
+}
+
+// walCommit is a queued write, done gets the result once it is durable as
+// the sync policy defines. Rotations and purges are queued as commits too so
+// they happen in order with the records.
+type walCommit struct {
+	data   []byte
+	rotate bool   // Move to file fileID before writing data
+	purge  bool   // Delete the files before fileID
+	fileID uint64 // File of a rotation or purge
+	done   chan error
+}
+
+// openWAL starts the WAL writer on a new file after the recovered ones.
+func (table *ydbTable) openWAL() error {
+	segmentSize := table.metadata.WALSegmentSize
+	if segmentSize <= 0 {
+		segmentSize = defaultWALSegmentSize
+	}
+	interval := table.metadata.WALSyncInterval
+	if interval <= 0 {
+		interval = defaultWALSyncInterval
+	}
+	w := &walWriter{
+		tableName:   table.metadata.TableName,
+		seq:         table.walSeq,
+		fileID:      table.nextWALID,
+		fileSize:    walHeaderSize,
+		segmentSize: segmentSize,
+		policy:      table.metadata.WALSyncPolicy,
+		interval:    interval,
+		queue:       make(chan *walCommit, walQueueSize),
+		stop:        make(chan struct{}),
+		done:        new(sync.WaitGroup),
+	}
+	if err := w.openFile(w.fileID); err != nil {
+		return err
+	}
+	table.wal = w
+	w.done.Add(1)
+	go w.loop()
+	return nil
+}
+
+// restartWAL moves the WAL to a new file written with the current options.
+// The old writer is stopped once the new one runs. Needs the table lock.
+func (table *ydbTable) restartWAL() error {
+	old := table.wal
+	table.walSeq = old.seq
+	table.nextWALID = old.fileID + 1
+	if err := table.openWAL(); err != nil {
+		return err
+	}
+	return old.close()
+}
+
+// closeWAL writes and syncs the queued records and stops the writer.
+func (table *ydbTable) closeWAL() error {
+	if table.wal == nil {
+		return nil
+	}
+	err := table.wal.close()
+	table.walSeq = table.wal.seq
+	table.nextWALID = table.wal.fileID + 1
+	table.wal = nil
+	return err
+}
+
+func walHeader() []byte {
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint64(header, walMagic)
+	return header
+}
+
+// openFile creates the WAL file fileID and makes it the one being written.
+func (w *walWriter) openFile(fileID uint64) error {
+	f, err := os.OpenFile(tableWALName(w.tableName, fileID), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(walHeader()); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if w.file != nil {
+		w.file.Close()
+	}
+	w.file = f
+	return nil
+}
+
+// append numbers records and queues them. The caller must hold the table
+// lock, so records keep the order of the memtable.
+func (w *walWriter) append(records []walRecord) *walCommit {
+	buf := new(bytes.Buffer)
+	for i := range records {
+		w.seq++
+		records[i].seq = w.seq
+		buf.Write(records[i].encode())
+	}
+	if w.fileSize > walHeaderSize && w.fileSize+int64(buf.Len()) > w.segmentSize {
+		w.rotate()
+	}
+	w.fileSize += int64(buf.Len())
+	return w.enqueue(&walCommit{data: buf.Bytes()})
+}
+
+// rotate sends the records queued from now on to a new file and returns its
+// ID. The caller must hold the table lock.
+func (w *walWriter) rotate() uint64 {
+	w.fileID++
+	w.fileSize = walHeaderSize
+	w.enqueue(&walCommit{rotate: true, fileID: w.fileID})
+	return w.fileID
+}
+
+// purge deletes the files before fileID once the records queued so far are
+// written. The caller must hold the table lock.
+func (w *walWriter) purge(fileID uint64) {
+	w.enqueue(&walCommit{purge: true, fileID: fileID})
+}
+
+func (w *walWriter) enqueue(c *walCommit) *walCommit {
+	c.done = make(chan error, 1)
+	w.queue <- c
+	return c
+}
+
+func (c *walCommit) wait() error {
+	return <-c.done
+}
+
+func (w *walWriter) loop() {
+	defer w.done.Done()
+	var tick <-chan time.Time
+	if w.policy == ydbserverrpc.SyncInterval {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	dirty := false
+	for {
+		select {
+		case c := <-w.queue:
+			batch := []*walCommit{c}
+			if w.policy != ydbserverrpc.SyncEveryWrite {
+				batch = w.collect(batch)
+			}
+			w.commit(batch, w.policy != ydbserverrpc.SyncInterval)
+			dirty = w.policy == ydbserverrpc.SyncInterval
+		case <-tick:
+			if dirty && w.err == nil {
+				w.sync()
+				dirty = false
+			}
+		case <-w.stop:
+			w.commit(w.collect(nil), true)
+			return
+		}
+	}
+}
+
+// collect adds the commits waiting in the queue to batch.
+func (w *walWriter) collect(batch []*walCommit) []*walCommit {
+	for len(batch) < walMaxBatch {
+		select {
+		case c := <-w.queue:
+			batch = append(batch, c)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// commit writes a batch and acknowledges it, after a sync when sync is set.
+// Records of one file are written with one write.
+func (w *walWriter) commit(batch []*walCommit, sync bool) {
+	buf := new(bytes.Buffer)
+	for _, c := range batch {
+		if w.err == nil && c.rotate {
+			if w.err = w.write(buf, true); w.err == nil {
+				w.err = w.openFile(c.fileID)
+			}
+		}
+		if w.err == nil && c.purge {
+			removeWALFiles(w.tableName, c.fileID)
+		}
+		buf.Write(c.data)
+	}
+	if w.err == nil {
+		w.err = w.write(buf, sync)
+	}
+	for _, c := range batch {
+		c.done <- w.err
+	}
+}
+
+func (w *walWriter) write(buf *bytes.Buffer, sync bool) error {
+	if buf.Len() > 0 {
+		if _, err := w.file.Write(buf.Bytes()); err != nil {
+			return err
+		}
+		buf.Reset()
+	}
+	if sync {
+		return w.sync()
+	}
+	return nil
+}
+
+func (w *walWriter) sync() error {
+	atomic.AddUint64(&w.syncs, 1)
+	return w.file.Sync()
+}
+
+// close writes and syncs the queued records and closes the file.
+func (w *walWriter) close() error {
+	close(w.stop)
+	w.done.Wait()
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.err
+}
+
+// walFileIDs returns the IDs of the WAL files of a table in order.
+func walFileIDs(tableName string) []uint64 {
+	ids := make([]uint64, 0)
+	prefix := "./" + tableName + "."
+	matches, _ := filepath.Glob(filepath.Join(".", "*.wal"))
+	for _, match := range matches {
+		name := "./" + match
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".wal"), 10, 64)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// removeWALFiles deletes the WAL files of a table before fileID.
+func removeWALFiles(tableName string, fileID uint64) {
+	for _, id := range walFileIDs(tableName) {
+		if id < fileID {
+			os.Remove(tableWALName(tableName, id))
+		}
+	}
+}
+
+// setWALCheckpoint records that the WAL files before fileID are flushed.
+func (table *ydbTable) setWALCheckpoint(ydb *ydbServer, fileID uint64) error {
+	return ydb.indexDB.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(table.metadata.TableName))
+		if err != nil {
+			return err
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, fileID)
+		return b.Put(walCheckpointKey, v)
+	})
+}
+
+// walCheckpoint returns the first WAL file that is not flushed.
+func (table *ydbTable) walCheckpoint(ydb *ydbServer) (uint64, error) {
+	var fileID uint64
+	err := ydb.indexDB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(table.metadata.TableName))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(walCheckpointKey); len(v) == 8 {
+			fileID = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return fileID, err
+}
+
+// applyWALRecord replays a record into the memtable.
+func (table *ydbTable) applyWALRecord(rec walRecord) {
+	switch rec.op {
+	case walOpPut:
+		for i, key := range rec.keys {
+			table.applyPut(rec.rowKey, key, YDBCell{Value: rec.values[i], Timestamp: table.timestamp(rec.timestamp), ExpireAt: rec.expireAt})
+		}
+	case walOpDelete:
+		for _, target := range rec.keys {
+			table.applyDelete(rec.rowKey, rec.kind, target, table.timestamp(rec.timestamp))
+		}
+	}
+}
+
+// recover rebuilds the memtable from the WAL files from the checkpoint on
+// and deletes the older ones.
+func (table *ydbTable) recover(ydb *ydbServer) error {
+	if err := table.migrateWAL(); err != nil {
+		return err
+	}
+	checkpoint, err := table.walCheckpoint(ydb)
+	if err != nil {
+		return err
+	}
+
+	table.data = newMemTable()
+	table.nextWALID = checkpoint
+	var lastSeq uint64
+	for _, id := range walFileIDs(table.metadata.TableName) {
+		path := tableWALName(table.metadata.TableName, id)
+		if id >= table.nextWALID {
+			table.nextWALID = id + 1
+		}
+		if id < checkpoint {
+			os.Remove(path)
+			continue
+		}
+		if lastSeq, err = readWAL(path, lastSeq, table.applyWALRecord); err != nil {
+			return err
+		}
+	}
+	table.walSeq = lastSeq
+	return nil
+}
+
+// migrateWAL moves the text WAL of the first version into a numbered WAL
+// file holding the same memtable.
+func (table *ydbTable) migrateWAL() error {
+	legacyPath := tableLegacyWALName(table.metadata.TableName)
+	if _, err := os.Stat(legacyPath); os.IsNotExist(err) {
+		return nil
+	}
+	if err := table.replayTextWAL(legacyPath); err != nil {
+		return err
+	}
+	var fileID uint64
+	if ids := walFileIDs(table.metadata.TableName); len(ids) > 0 {
+		fileID = ids[len(ids)-1] + 1
+	}
+	if err := table.rewriteWAL(tableWALName(table.metadata.TableName, fileID)); err != nil {
+		return err
+	}
+	return os.Remove(legacyPath)
+}
+
+func (table *ydbTable) replayTextWAL(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	table.data = newMemTable()
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString(byte('\n'))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		parts := strings.SplitN(strings.Trim(line, "\n"), "|", 3)
+		if len(parts) == 1 && parts[0] != "" {
+			table.data = newMemTable()
+		} else if len(parts) == 3 {
+			table.applyPut(parts[0], parts[1], YDBCell{Value: []byte(parts[2]), Timestamp: table.timestamp(0)})
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// rewriteWAL writes a WAL file at path with records that rebuild the
+// memtable. The file is written aside and renamed into place.
+func (table *ydbTable) rewriteWAL(path string) error {
+	records := make([]walRecord, 0)
+	it := table.data.iterator()
+	for it.seek(""); it.valid(); it.next() {
+		rowKey := it.key()
+		col, _ := it.row()
+		if col.RowDeleted > 0 {
+			records = append(records, walRecord{op: walOpDelete, rowKey: rowKey, timestamp: col.RowDeleted, kind: walDeleteRow, keys: []string{""}})
+		}
+		for family, timestamp := range col.DeletedFamilies {
+			records = append(records, walRecord{op: walOpDelete, rowKey: rowKey, timestamp: timestamp, kind: walDeleteFamily, keys: []string{family}})
+		}
+		for key, timestamp := range col.DeletedColumns {
+			records = append(records, walRecord{op: walOpDelete, rowKey: rowKey, timestamp: timestamp, kind: walDeleteColumn, keys: []string{key}})
+		}
+		for key, cells := range col.Columns {
+			for _, cell := range cells {
+				records = append(records, walRecord{op: walOpPut, rowKey: rowKey, timestamp: cell.Timestamp, expireAt: cell.ExpireAt, keys: []string{key}, values: [][]byte{cell.Value}})
+			}
+		}
+	}
+
+	buf := bytes.NewBuffer(walHeader())
+	for i := range records {
+		records[i].seq = uint64(i + 1)
+		buf.Write(records[i].encode())
+	}
+	tmpPath := path + ".tmp"
+	wal, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = wal.Write(buf.Bytes()); err == nil {
+		err = wal.Sync()
+	}
+	wal.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func putBytes(buf *bytes.Buffer, b []byte) {
+	putUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func putVarint(buf *bytes.Buffer, x int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], x)
+	buf.Write(tmp[:n])
+}
+
+func readString(reader *bytes.Reader) (string, error) {
+	b, err := readBytes(reader)
+	return string(b), err
+}
@@ -0,0 +1,521 @@
+package ydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultMaxVersions = 1 // Versions kept per cell when the family sets none
+
+// YDBCell is one version of a column value. Values, like row keys and column
+// keys, are arbitrary bytes.
+type YDBCell struct {
+	Value     []byte
+	Timestamp int64 // Unix nanoseconds
+	ExpireAt  int64 // Unix nanoseconds after which the cell is gone, 0 for never
+}
+
+// expired tells whether the cell outlived its own TTL, or familyTTL counted
+// from its timestamp, at now.
+func (cell YDBCell) expired(now int64, familyTTL time.Duration) bool {
+	if cell.ExpireAt != 0 && cell.ExpireAt <= now {
+		return true
+	}
+	return familyTTL > 0 && cell.Timestamp+int64(familyTTL) <= now
+}
+
+// YDBColumn is one copy of a row, in the memtable or in a segment. A tombstone
+// hides every version of its scope with a timestamp up to its own, in this
+// copy and in all others.
+type YDBColumn struct {
+	Columns         map[string][]YDBCell // Key is column family:qualifier, versions are newest first
+	DeletedColumns  map[string]int64     // Family:qualifier -> delete timestamp
+	DeletedFamilies map[string]int64     // Column family -> delete timestamp
+	RowDeleted      int64                // Delete timestamp of the whole row
+}
+
+// versionRange selects the versions returned by reads.
+type versionRange struct {
+	maxVersions  int   // Versions per column, 0 for the latest only
+	minTimestamp int64 // Inclusive lower bound
+	maxTimestamp int64 // Exclusive upper bound, 0 for none
+}
+
+func newYDBColumn() YDBColumn {
+	return YDBColumn{
+		Columns: make(map[string][]YDBCell),
+	}
+}
+
+// columnFamily returns the family of a family:qualifier key.
+func columnFamily(key string) string {
+	if i := strings.Index(key, ":"); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// columnSet selects the columns read, by family or by family:qualifier key.
+// A nil set selects every column.
+type columnSet map[string]bool
+
+var errInvalidColumns = errors.New("Invalid column selection.")
+
+// newColumnSet builds the set of the families and family:qualifier columns
+// in names, nil when names is empty.
+func newColumnSet(names []string) (columnSet, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	set := make(columnSet)
+	for _, name := range names {
+		if name == "" || strings.HasPrefix(name, ":") || strings.HasSuffix(name, ":") {
+			return nil, errInvalidColumns
+		}
+		set[name] = true
+	}
+	return set, nil
+}
+
+// contains tells whether the column key is selected.
+func (set columnSet) contains(key string) bool {
+	return set == nil || set[key] || set[columnFamily(key)]
+}
+
+// hasFamily tells whether a column of family is selected.
+func (set columnSet) hasFamily(family string) bool {
+	if set == nil || set[family] {
+		return true
+	}
+	for key := range set {
+		if columnFamily(key) == family {
+			return true
+		}
+	}
+	return false
+}
+
+// put adds a version of a column, replacing one with the same timestamp.
+func (col *YDBColumn) put(key string, cell YDBCell) {
+	col.Columns[key] = mergeCells(col.Columns[key], []YDBCell{cell})
+	col.applyTombstones()
+}
+
+// merge adds the versions and tombstones of another copy of the row. When
+// both copies hold the same version, other wins, so it must be the newer
+// copy.
+func (col *YDBColumn) merge(other YDBColumn) {
+	col.mergeColumns(other, nil)
+}
+
+// mergeColumns merges like merge, but only the versions of the columns in
+// set. Tombstones are merged whole, they are small.
+func (col *YDBColumn) mergeColumns(other YDBColumn, set columnSet) {
+	if other.RowDeleted > col.RowDeleted {
+		col.RowDeleted = other.RowDeleted
+	}
+	for family, timestamp := range other.DeletedFamilies {
+		col.deleteFamily(family, timestamp)
+	}
+	for key, timestamp := range other.DeletedColumns {
+		col.deleteColumn(key, timestamp)
+	}
+	for key, cells := range other.Columns {
+		if set.contains(key) {
+			col.Columns[key] = mergeCells(col.Columns[key], cells)
+		}
+	}
+	col.applyTombstones()
+}
+
+// mergeCells merges two newest first version lists, newer wins on equal
+// timestamps.
+func mergeCells(older []YDBCell, newer []YDBCell) []YDBCell {
+	merged := make([]YDBCell, 0, len(older)+len(newer))
+	i, j := 0, 0
+	for i < len(older) || j < len(newer) {
+		switch {
+		case j == len(newer) || (i < len(older) && older[i].Timestamp > newer[j].Timestamp):
+			merged = append(merged, older[i])
+			i++
+		case i == len(older) || newer[j].Timestamp > older[i].Timestamp:
+			merged = append(merged, newer[j])
+			j++
+		default:
+			merged = append(merged, newer[j])
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+func (col *YDBColumn) deleteRow(timestamp int64) {
+	if timestamp > col.RowDeleted {
+		col.RowDeleted = timestamp
+	}
+	col.applyTombstones()
+}
+
+func (col *YDBColumn) deleteFamily(family string, timestamp int64) {
+	if col.DeletedFamilies == nil {
+		col.DeletedFamilies = make(map[string]int64)
+	}
+	if timestamp > col.DeletedFamilies[family] {
+		col.DeletedFamilies[family] = timestamp
+	}
+	col.applyTombstones()
+}
+
+func (col *YDBColumn) deleteColumn(key string, timestamp int64) {
+	if col.DeletedColumns == nil {
+		col.DeletedColumns = make(map[string]int64)
+	}
+	if timestamp > col.DeletedColumns[key] {
+		col.DeletedColumns[key] = timestamp
+	}
+	col.applyTombstones()
+}
+
+// deletedUntil returns the newest tombstone covering a column.
+func (col *YDBColumn) deletedUntil(key string) int64 {
+	deleted := col.RowDeleted
+	if timestamp := col.DeletedFamilies[columnFamily(key)]; timestamp > deleted {
+		deleted = timestamp
+	}
+	if timestamp := col.DeletedColumns[key]; timestamp > deleted {
+		deleted = timestamp
+	}
+	return deleted
+}
+
+// applyTombstones removes the versions hidden by tombstones.
+func (col *YDBColumn) applyTombstones() {
+	if !col.hasTombstones() {
+		return
+	}
+	for key, cells := range col.Columns {
+		deleted := col.deletedUntil(key)
+		live := make([]YDBCell, 0, len(cells))
+		for _, cell := range cells {
+			if cell.Timestamp > deleted {
+				live = append(live, cell)
+			}
+		}
+		if len(live) == 0 {
+			delete(col.Columns, key)
+		} else {
+			col.Columns[key] = live
+		}
+	}
+}
+
+func (col *YDBColumn) hasTombstones() bool {
+	return col.RowDeleted > 0 || len(col.DeletedFamilies) > 0 || len(col.DeletedColumns) > 0
+}
+
+// dropTombstones forgets the deletes once no older copy can exist.
+func (col *YDBColumn) dropTombstones() {
+	col.DeletedColumns = nil
+	col.DeletedFamilies = nil
+	col.RowDeleted = 0
+}
+
+// trimVersions keeps at most maxVersions(family) versions of every column.
+func (col *YDBColumn) trimVersions(maxVersions func(family string) int) {
+	for key, cells := range col.Columns {
+		if limit := maxVersions(columnFamily(key)); len(cells) > limit {
+			col.Columns[key] = cells[:limit]
+		}
+	}
+}
+
+// dropExpired removes the versions that expired at now.
+func (col *YDBColumn) dropExpired(now int64, ttl func(family string) time.Duration) {
+	for key, cells := range col.Columns {
+		familyTTL := ttl(columnFamily(key))
+		live := make([]YDBCell, 0, len(cells))
+		for _, cell := range cells {
+			if !cell.expired(now, familyTTL) {
+				live = append(live, cell)
+			}
+		}
+		if len(live) == 0 {
+			delete(col.Columns, key)
+		} else if len(live) < len(cells) {
+			col.Columns[key] = live
+		}
+	}
+}
+
+// family returns the part of the row stored with family: its columns, their
+// tombstones and the row tombstone, which every family keeps.
+func (col *YDBColumn) family(family string) YDBColumn {
+	part := newYDBColumn()
+	part.RowDeleted = col.RowDeleted
+	if timestamp, ok := col.DeletedFamilies[family]; ok {
+		part.DeletedFamilies = map[string]int64{family: timestamp}
+	}
+	for key, timestamp := range col.DeletedColumns {
+		if columnFamily(key) == family {
+			if part.DeletedColumns == nil {
+				part.DeletedColumns = make(map[string]int64)
+			}
+			part.DeletedColumns[key] = timestamp
+		}
+	}
+	for key, cells := range col.Columns {
+		if columnFamily(key) == family {
+			part.Columns[key] = cells
+		}
+	}
+	return part
+}
+
+// dropFamilies removes the columns and tombstones of families from the row.
+func (col *YDBColumn) dropFamilies(families map[string]bool) {
+	for family := range col.DeletedFamilies {
+		if families[family] {
+			delete(col.DeletedFamilies, family)
+		}
+	}
+	for key := range col.DeletedColumns {
+		if families[columnFamily(key)] {
+			delete(col.DeletedColumns, key)
+		}
+	}
+	for key := range col.Columns {
+		if families[columnFamily(key)] {
+			delete(col.Columns, key)
+		}
+	}
+}
+
+// families adds the families of the columns and tombstones of the row to
+// families.
+func (col *YDBColumn) families(families map[string]bool) {
+	for family := range col.DeletedFamilies {
+		families[family] = true
+	}
+	for key := range col.DeletedColumns {
+		families[columnFamily(key)] = true
+	}
+	for key := range col.Columns {
+		families[columnFamily(key)] = true
+	}
+}
+
+// empty tells whether the row holds neither a version nor a tombstone.
+func (col *YDBColumn) empty() bool {
+	return len(col.Columns) == 0 && !col.hasTombstones()
+}
+
+// size approximates the memory taken by the row in bytes.
+func (col *YDBColumn) size() int64 {
+	size := int64(8)
+	for key, cells := range col.Columns {
+		size += int64(len(key))
+		for _, cell := range cells {
+			size += int64(len(cell.Value)) + 16
+		}
+	}
+	for key := range col.DeletedColumns {
+		size += int64(len(key)) + 8
+	}
+	for family := range col.DeletedFamilies {
+		size += int64(len(family)) + 8
+	}
+	return size
+}
+
+// project returns the versions of every column in r, without tombstones.
+func (col *YDBColumn) project(r versionRange, maxVersions func(family string) int) map[string][]YDBCell {
+	projected := make(map[string][]YDBCell)
+	for key, cells := range col.Columns {
+		limit := maxVersions(columnFamily(key))
+		if r.maxVersions < limit {
+			limit = r.maxVersions
+		}
+		if limit < 1 {
+			limit = 1
+		}
+		selected := make([]YDBCell, 0, limit)
+		for _, cell := range cells {
+			if len(selected) == limit {
+				break
+			}
+			if cell.Timestamp >= r.minTimestamp && (r.maxTimestamp == 0 || cell.Timestamp < r.maxTimestamp) {
+				selected = append(selected, cell)
+			}
+		}
+		if len(selected) > 0 {
+			projected[key] = selected
+		}
+	}
+	return projected
+}
+
+// latestValues returns the newest value of every column in versions, as text
+// for the JSON replies.
+func latestValues(versions map[string][]YDBCell) map[string]string {
+	values := make(map[string]string)
+	for key, cells := range versions {
+		values[key] = string(cells[0].Value)
+	}
+	return values
+}
+
+// jsonCell is a cell with its value as text, the form of the JSON replies.
+type jsonCell struct {
+	Value     string
+	Timestamp int64
+	ExpireAt  int64 `json:",omitempty"`
+}
+
+// jsonVersions converts versions to their JSON form.
+func jsonVersions(versions map[string][]YDBCell) map[string][]jsonCell {
+	converted := make(map[string][]jsonCell)
+	for key, cells := range versions {
+		for _, cell := range cells {
+			converted[key] = append(converted[key], jsonCell{Value: string(cell.Value), Timestamp: cell.Timestamp, ExpireAt: cell.ExpireAt})
+		}
+	}
+	return converted
+}
+
+// encode writes the row in the binary segment format: the row tombstone,
+// the family and column tombstones, then every column with its versions,
+// each part in key order.
+func (col *YDBColumn) encode() []byte {
+	buf := new(bytes.Buffer)
+	putVarint(buf, col.RowDeleted)
+	putTombstones(buf, col.DeletedFamilies)
+	putTombstones(buf, col.DeletedColumns)
+	keys := make([]string, 0, len(col.Columns))
+	for key := range col.Columns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	putUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		putString(buf, key)
+		putUvarint(buf, uint64(len(col.Columns[key])))
+		for _, cell := range col.Columns[key] {
+			putBytes(buf, cell.Value)
+			putVarint(buf, cell.Timestamp)
+			putVarint(buf, cell.ExpireAt)
+		}
+	}
+	return buf.Bytes()
+}
+
+func putTombstones(buf *bytes.Buffer, tombstones map[string]int64) {
+	keys := make([]string, 0, len(tombstones))
+	for key := range tombstones {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	putUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		putString(buf, key)
+		putVarint(buf, tombstones[key])
+	}
+}
+
+func decodeRow(data []byte) (YDBColumn, error) {
+	col := newYDBColumn()
+	reader := bytes.NewReader(data)
+	var err error
+	if col.RowDeleted, err = binary.ReadVarint(reader); err != nil {
+		return col, errCorruptSegment
+	}
+	if col.DeletedFamilies, err = readTombstones(reader); err != nil {
+		return col, err
+	}
+	if col.DeletedColumns, err = readTombstones(reader); err != nil {
+		return col, err
+	}
+	n, err := readCount(reader)
+	if err != nil {
+		return col, err
+	}
+	for ; n > 0; n-- {
+		key, err := readString(reader)
+		if err != nil {
+			return col, err
+		}
+		versions, err := readCount(reader)
+		if err != nil {
+			return col, err
+		}
+		cells := make([]YDBCell, versions)
+		for i := range cells {
+			if cells[i].Value, err = readBytes(reader); err != nil {
+				return col, err
+			}
+			if cells[i].Timestamp, err = binary.ReadVarint(reader); err != nil {
+				return col, errCorruptSegment
+			}
+			if cells[i].ExpireAt, err = binary.ReadVarint(reader); err != nil {
+				return col, errCorruptSegment
+			}
+		}
+		col.Columns[key] = cells
+	}
+	return col, nil
+}
+
+// readTombstones reads the tombstones written by putTombstones, nil for none.
+func readTombstones(reader *bytes.Reader) (map[string]int64, error) {
+	n, err := readCount(reader)
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	tombstones := make(map[string]int64)
+	for ; n > 0; n-- {
+		key, err := readString(reader)
+		if err != nil {
+			return nil, err
+		}
+		if tombstones[key], err = binary.ReadVarint(reader); err != nil {
+			return nil, errCorruptSegment
+		}
+	}
+	return tombstones, nil
+}
+
+// readCount reads the number of the following items, each taking a byte at
+// least.
+func readCount(reader *bytes.Reader) (uint64, error) {
+	n, err := binary.ReadUvarint(reader)
+	if err != nil || n > uint64(reader.Len()) {
+		return 0, errCorruptSegment
+	}
+	return n, nil
+}
+
+// legacyColumn is the row format of the line based data file of the first
+// format, written before cells had versions.
+type legacyColumn struct {
+	Columns map[string]string
+}
+
+// decodeLegacyRow converts a row of line lineNo of the old data file. Values
+// get timestamp lineNo+1, so later lines stay newer and all of them stay
+// older than any real timestamp.
+func decodeLegacyRow(data []byte, lineNo uint64) (YDBColumn, error) {
+	var legacy legacyColumn
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return YDBColumn{}, err
+	}
+	col := newYDBColumn()
+	for key, value := range legacy.Columns {
+		col.put(key, YDBCell{Value: []byte(value), Timestamp: int64(lineNo + 1)})
+	}
+	return col, nil
+}
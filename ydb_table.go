@@ -2,12 +2,13 @@ package ydb
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/boylee1111/ydb/ydbserverrpc"
 	"go.etcd.io/bbolt"
 	"io"
-	"log"
 	"os"
 	"sort"
 	"strings"
@@ -16,289 +17,1373 @@ import (
 )
 
 type TableMeta struct {
-	TableName       string    // Table name
-	ColumnsFamilies []string  // Column family
-	MemTableLimit   int       // Max limit rows for table in memory
-	CreationTime    time.Time // Table create time
+	TableName          string    // Table name
+	ColumnsFamilies    []string  // Column family
+	MemTableLimit      int64     // Memtable budget in bytes
+	BloomFalsePositive float64   // False positive rate of segment bloom filters, 0 for default
+	CreationTime       time.Time // Table create time
+	Version            int       // Format of the metadata, 0 before budgets were in bytes
+
+	FamilyOptions map[string]ydbserverrpc.ColumnFamilyOptions // Column family -> options
+
+	WALSyncPolicy   ydbserverrpc.SyncPolicy // When WAL writes are synced
+	WALSyncInterval time.Duration           // Sync period of SyncInterval, 0 for default
+	WALSegmentSize  int64                   // Size at which the WAL moves to a new file, 0 for default
+
+	Compression           ydbserverrpc.Compression        // Codec of families without their own
+	MaxVersions           int                             // Versions kept in families without their own, 0 for default
+	TTL                   time.Duration                   // Cell lifetime in families without their own, 0 for ever
+	Compaction            ydbserverrpc.CompactionStrategy // How segments are compacted
+	CompactionMinSegments int                             // Shortest run merged by size-tiered compaction, 0 for default
 }
 
-type ydbTable struct {
-	metadata   TableMeta
-	data       map[string]YDBColumn // Row Key -> column data
-	dataLocker *sync.RWMutex        // Mutex for data store
-	//inOpen     bool                 // Is opened
+// options returns the table options the metadata records.
+func (meta *TableMeta) options() ydbserverrpc.TableOptions {
+	return ydbserverrpc.TableOptions{
+		MemTableLimit:         meta.MemTableLimit,
+		WALSyncPolicy:         meta.WALSyncPolicy,
+		WALSyncInterval:       meta.WALSyncInterval,
+		WALSegmentSize:        meta.WALSegmentSize,
+		Compression:           meta.Compression,
+		BloomFalsePositive:    meta.BloomFalsePositive,
+		MaxVersions:           meta.MaxVersions,
+		TTL:                   meta.TTL,
+		Compaction:            meta.Compaction,
+		CompactionMinSegments: meta.CompactionMinSegments,
+	}
 }
 
-type YDBColumn struct {
-	Columns map[string]string // Key is column family:qualifier, val is value
+// setOptions records options in the metadata, with the default memtable
+// budget for 0.
+func (meta *TableMeta) setOptions(options ydbserverrpc.TableOptions) {
+	meta.MemTableLimit = options.MemTableLimit
+	if meta.MemTableLimit == 0 {
+		meta.MemTableLimit = defaultMemTableLimit
+	}
+	meta.WALSyncPolicy = options.WALSyncPolicy
+	meta.WALSyncInterval = options.WALSyncInterval
+	meta.WALSegmentSize = options.WALSegmentSize
+	meta.Compression = options.Compression
+	meta.BloomFalsePositive = options.BloomFalsePositive
+	meta.MaxVersions = options.MaxVersions
+	meta.TTL = options.TTL
+	meta.Compaction = options.Compaction
+	meta.CompactionMinSegments = options.CompactionMinSegments
 }
 
-func (col *YDBColumn) merge(other YDBColumn) {
-	for key, value := range other.Columns {
-		col.Columns[key] = value
+// segmentOptions are the options segments are written with.
+type segmentOptions struct {
+	compression        ydbserverrpc.Compression
+	bloomFalsePositive float64
+	maxVersions        int
+	ttl                time.Duration
+	families           map[string]ydbserverrpc.ColumnFamilyOptions // Column family -> options
+}
+
+// segmentOptions returns the segment options of the metadata, sharing its
+// family options.
+func (meta *TableMeta) segmentOptions() segmentOptions {
+	return segmentOptions{
+		compression:        meta.Compression,
+		bloomFalsePositive: meta.BloomFalsePositive,
+		maxVersions:        meta.MaxVersions,
+		ttl:                meta.TTL,
+		families:           meta.FamilyOptions,
 	}
 }
 
-func (col *YDBColumn) toString() string {
-	ret, _ := json.Marshal(col)
-	return string(ret)
+// familyCompression returns the codec of the segments of family.
+func (o segmentOptions) familyCompression(family string) ydbserverrpc.Compression {
+	if options := o.families[family]; options.HasCompression || options.Compression != ydbserverrpc.CompressionNone {
+		return options.Compression
+	}
+	return o.compression
 }
 
-func lineCounter(r io.Reader) (int, error) {
-	buf := make([]byte, 32*1024)
-	count := 0
-	lineSep := []byte{'\n'}
+func (o segmentOptions) falsePositive() float64 {
+	if o.bloomFalsePositive == 0 {
+		return defaultBloomFalsePositive
+	}
+	return o.bloomFalsePositive
+}
 
-	for {
-		c, err := r.Read(buf)
-		count += bytes.Count(buf[:c], lineSep)
+// familyMaxVersions returns how many versions of a cell the family keeps.
+func (o segmentOptions) familyMaxVersions(family string) int {
+	if options, ok := o.families[family]; ok && options.MaxVersions > 0 {
+		return options.MaxVersions
+	}
+	if o.maxVersions > 0 {
+		return o.maxVersions
+	}
+	return defaultMaxVersions
+}
 
-		switch {
-		case err == io.EOF:
-			return count, nil
+// familyTTL returns how long the cells of the family live, 0 for ever.
+func (o segmentOptions) familyTTL(family string) time.Duration {
+	if options := o.families[family]; options.HasTTL || options.TTL > 0 {
+		return options.TTL
+	}
+	return o.ttl
+}
+
+type ydbTable struct {
+	metadata      TableMeta
+	data          *memTable      // Row Key -> column data
+	dataLocker    *sync.RWMutex  // Mutex for data store
+	configLocker  *sync.Mutex    // Serializes the schema and option changes
+	immutable     *memTable      // Full memtable being flushed, nil when none
+	immutableWAL  uint64         // WAL checkpoint once immutable is flushed
+	immutableOpts segmentOptions // Options immutable is written with
+	flushed       *sync.Cond     // Signals the end of a flush, on dataLocker
+	flushErr      error          // Error of the last flush
+	flusher       *flusher       // Background flush of the immutable memtable
+	segments      []*segment     // Flushed segments, oldest first
+	nextSegmentID uint64         // File number of the next segment
+	compactor     *compactor     // Background compaction of segments, set under both locks
+	lastTimestamp int64          // Newest timestamp handed out or recovered
+	walSeq        uint64         // Sequence number of the last recovered WAL record
+	nextWALID     uint64         // ID of the WAL file the writer starts with
+	wal           *walWriter     // Appends to the WAL while the table is open
+	//inOpen     bool                 // Is opened
+}
+
+// Scopes of a delete.
+const (
+	walDeleteRow    = "row"
+	walDeleteFamily = "family"
+	walDeleteColumn = "column"
+)
+
+var (
+	segmentBucket  = []byte("segments") // Segment ID -> segment metadata
+	rowIndexBucket = []byte("rows")     // Row key -> locations of the row records
+)
 
-		case err != nil:
-			return count, err
+var (
+	errUnknownFamily   = errors.New("Unknown column family.")
+	errInvalidFamilies = errors.New("Invalid column family change.")
+)
+
+// rowLocation points at the record of a row inside a segment file.
+type rowLocation struct {
+	Segment uint64 // Segment ID
+	Offset  int64  // Record position in the file, -1 in compressed blocks
+	Length  int64  // Record length in bytes
+}
+
+// decodeRowLocations reads a row index entry.
+func decodeRowLocations(v []byte) ([]rowLocation, error) {
+	locs := make([]rowLocation, 0)
+	if err := json.Unmarshal(v, &locs); err != nil {
+		return nil, err
+	}
+	return locs, nil
+}
+
+// indexRows adds the new record locations to the row index, dropping the
+// locations in replaced segments.
+func indexRows(rowIndex *bbolt.Bucket, keys []string, newLocs []rowLocation, replaced map[uint64]bool) error {
+	for i, key := range keys {
+		locs := make([]rowLocation, 0)
+		if v := rowIndex.Get([]byte(key)); v != nil {
+			old, err := decodeRowLocations(v)
+			if err != nil {
+				return err
+			}
+			for _, loc := range old {
+				if !replaced[loc.Segment] {
+					locs = append(locs, loc)
+				}
+			}
+		}
+		v, err := json.Marshal(append(locs, newLocs[i]))
+		if err != nil {
+			return err
+		}
+		if err := rowIndex.Put([]byte(key), v); err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
-func (table *ydbTable) filePath() string {
-	return "./" + table.metadata.TableName + ".ydb"
+func segmentKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
 }
 
-func (table *ydbTable) walPath() string {
-	return "./" + table.metadata.TableName + ".wal"
+// unindexRows removes the locations in replaced segments of rows that were
+// dropped, and the rows that have no location left.
+func unindexRows(rowIndex *bbolt.Bucket, keys []string, replaced map[uint64]bool) error {
+	for _, key := range keys {
+		v := rowIndex.Get([]byte(key))
+		if v == nil {
+			continue
+		}
+		old, err := decodeRowLocations(v)
+		if err != nil {
+			return err
+		}
+		locs := make([]rowLocation, 0, len(old))
+		for _, loc := range old {
+			if !replaced[loc.Segment] {
+				locs = append(locs, loc)
+			}
+		}
+		if len(locs) == 0 {
+			if err := rowIndex.Delete([]byte(key)); err != nil {
+				return err
+			}
+			continue
+		}
+		if v, err = json.Marshal(locs); err != nil {
+			return err
+		}
+		if err := rowIndex.Put([]byte(key), v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (table *ydbTable) recover() error{
-	f, err := os.OpenFile(table.walPath(), os.O_RDONLY, 0755)
+// createTableBuckets returns the segment and row index buckets of a table,
+// creating them when missing.
+func createTableBuckets(tx *bbolt.Tx, tableName string) (*bbolt.Bucket, *bbolt.Bucket, error) {
+	b, err := tx.CreateBucketIfNotExists([]byte(tableName))
 	if err != nil {
+		return nil, nil, err
+	}
+	segments, err := b.CreateBucketIfNotExists(segmentBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	rowIndex, err := b.CreateBucketIfNotExists(rowIndexBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return segments, rowIndex, nil
+}
+
+func (table *ydbTable) bloomFalsePositive() float64 {
+	return table.metadata.segmentOptions().falsePositive()
+}
+
+// compression returns the codec of the segments of family.
+func (table *ydbTable) compression(family string) ydbserverrpc.Compression {
+	return table.metadata.segmentOptions().familyCompression(family)
+}
+
+// snapshotOptions copies the segment options for a flush or a compaction,
+// which write segments without the table lock while the options may change.
+// Needs the table lock.
+func (table *ydbTable) snapshotOptions() segmentOptions {
+	o := table.metadata.segmentOptions()
+	o.families = make(map[string]ydbserverrpc.ColumnFamilyOptions, len(table.metadata.FamilyOptions))
+	for family, options := range table.metadata.FamilyOptions {
+		o.families[family] = options
+	}
+	return o
+}
+
+// hasFamily tells whether family is declared by the table.
+func (table *ydbTable) hasFamily(family string) bool {
+	return hasColumnFamily(table.metadata.ColumnsFamilies, family)
+}
+
+// maxVersions returns how many versions of a cell the family keeps.
+func (table *ydbTable) maxVersions(family string) int {
+	return table.metadata.segmentOptions().familyMaxVersions(family)
+}
+
+// ttl returns how long the cells of the family live, 0 for ever.
+func (table *ydbTable) ttl(family string) time.Duration {
+	return table.metadata.segmentOptions().familyTTL(family)
+}
+
+// timestamp returns requested, or a server timestamp when it is 0. Server
+// timestamps are strictly increasing so writes of the table keep their order.
+func (table *ydbTable) timestamp(requested int64) int64 {
+	if requested != 0 {
+		if requested > table.lastTimestamp {
+			table.lastTimestamp = requested
+		}
+		return requested
+	}
+	timestamp := time.Now().UnixNano()
+	if timestamp <= table.lastTimestamp {
+		timestamp = table.lastTimestamp + 1
+	}
+	table.lastTimestamp = timestamp
+	return timestamp
+}
+
+// flush writes the memtable into a new segment and waits for it. Needs the
+// table lock.
+func (table *ydbTable) flush(ydb *ydbServer) error {
+	if err := table.freeze(); err != nil {
 		return err
 	}
+	for table.immutable != nil && table.flushErr == nil {
+		table.flushed.Wait()
+	}
+	return table.flushErr
+}
 
-	defer f.Close()
-	reader := bufio.NewReader(f)
+// freeze hands the memtable to the flusher and starts an empty one. Later
+// records go to a new WAL file, which becomes the checkpoint once the frozen
+// memtable is stored. While an older memtable is still being flushed the
+// writer waits, so memory stays bounded when flushes fall behind. Needs the
+// table lock.
+func (table *ydbTable) freeze() error {
+	for table.immutable != nil && table.flushErr == nil {
+		table.flushed.Wait()
+	}
+	if table.immutable != nil {
+		// The last flush failed, have it tried again
+		err := table.flushErr
+		table.flushErr = nil
+		table.flusher.notify()
+		return err
+	}
+	table.immutable = table.data
+	table.immutableWAL = table.wal.rotate()
+	table.immutableOpts = table.snapshotOptions()
+	table.data = newMemTable()
+	table.flusher.notify()
+	return nil
+}
+
+// flusher writes frozen memtables of one table in a background goroutine.
+type flusher struct {
+	wake chan struct{} // Signals a frozen memtable
+	stop chan struct{}
+	done *sync.WaitGroup
+}
+
+func (table *ydbTable) startFlusher(ydb *ydbServer) {
+	table.flusher = &flusher{
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: new(sync.WaitGroup),
+	}
+	table.flusher.done.Add(1)
+	go table.flushLoop(ydb)
+	table.flusher.notify()
+}
+
+// stopFlusher waits for a running flush and for the loop to exit.
+func (table *ydbTable) stopFlusher() {
+	if table.flusher == nil {
+		return
+	}
+	close(table.flusher.stop)
+	table.flusher.done.Wait()
+}
 
-	table.data = make(map[string]YDBColumn)
+func (f *flusher) notify() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
 
+func (table *ydbTable) flushLoop(ydb *ydbServer) {
+	f := table.flusher
+	defer f.done.Done()
 	for {
-		line, err := reader.ReadString(byte('\n'))
-		if err == nil || err != io.EOF {
-			parts := strings.Split(line, "|")
-			if len(parts) == 1 {
-				table.data = make(map[string]YDBColumn)
-			} else {
-				rowKey := parts[0]
-				key := parts[1]
-				value := parts[2]
-				value = strings.Trim(value, "\n")
-				if _, ok := table.data[rowKey]; !ok {
-					table.data[rowKey] = YDBColumn{
-						Columns:make(map[string]string),
-					}
-				}
-				table.data[rowKey].Columns[key] = value
-			}
+		select {
+		case <-f.stop:
+			return
+		case <-f.wake:
+		}
+
+		table.dataLocker.RLock()
+		rows, checkpoint, options := table.immutable, table.immutableWAL, table.immutableOpts
+		table.dataLocker.RUnlock()
+		if rows != nil {
+			table.flushImmutable(ydb, rows, checkpoint, options)
+		}
+	}
+}
+
+// flushImmutable writes the frozen memtable with the options copied when it
+// was frozen, without holding the table lock, then swaps it for the new
+// segments and deletes the WAL files it made obsolete. A failed flush keeps
+// the memtable frozen until it is retried.
+func (table *ydbTable) flushImmutable(ydb *ydbServer, rows *memTable, checkpoint uint64, options segmentOptions) {
+	rowFamilies := memTableFamilies(rows)
+	table.dataLocker.Lock()
+	families := table.segmentFamilies(rowFamilies)
+	id := table.nextSegmentID
+	table.nextSegmentID += uint64(len(families))
+	table.dataLocker.Unlock()
+
+	segments, err := table.buildSegments(ydb, id, families, rows, options)
+
+	table.dataLocker.Lock()
+	defer table.dataLocker.Unlock()
+	defer table.flushed.Broadcast()
+	if len(segments) > 0 {
+		table.segments = append(table.segments, segments...)
+		if table.compactor != nil {
+			table.compactor.notify()
+		}
+	}
+	if err == nil {
+		err = table.setWALCheckpoint(ydb, checkpoint)
+	}
+	if err != nil {
+		table.flushErr = err
+		return
+	}
+	table.wal.purge(checkpoint)
+	table.immutable = nil
+	table.flushErr = nil
+}
+
+// writeSegments stores rows as new segments and adds them to the table. Needs
+// the table lock.
+func (table *ydbTable) writeSegments(ydb *ydbServer, rows *memTable) error {
+	families := table.segmentFamilies(memTableFamilies(rows))
+	id := table.nextSegmentID
+	table.nextSegmentID += uint64(len(families))
+	segments, err := table.buildSegments(ydb, id, families, rows, table.metadata.segmentOptions())
+	table.segments = append(table.segments, segments...)
+	return err
+}
 
-			if err == io.EOF {
-				return nil
+// memTableFamilies returns the families of the columns and tombstones of
+// rows.
+func memTableFamilies(rows *memTable) map[string]bool {
+	families := make(map[string]bool)
+	it := rows.iterator()
+	for it.seek(""); it.valid(); it.next() {
+		row, _ := it.row()
+		row.families(families)
+	}
+	return families
+}
+
+// segmentFamilies returns, sorted, the families a flush writes segments for:
+// those in families, the declared ones and those of the current segments,
+// which row tombstones must reach. Needs the table lock.
+func (table *ydbTable) segmentFamilies(families map[string]bool) []string {
+	all := make(map[string]bool)
+	for family := range families {
+		all[family] = true
+	}
+	for _, family := range table.metadata.ColumnsFamilies {
+		all[family] = true
+	}
+	for _, seg := range table.segments {
+		if seg.meta.Family != "" {
+			all[seg.meta.Family] = true
+		}
+	}
+	sorted := make([]string, 0, len(all))
+	for family := range all {
+		sorted = append(sorted, family)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// buildSegments writes the part of rows of each of families into a segment
+// of its own, numbered from id on, and registers them, together with the row
+// keys they hold, in the index db at once. Families without a live row get
+// no segment. Rows are left as they are.
+func (table *ydbTable) buildSegments(ydb *ydbServer, id uint64, families []string, rows *memTable, options segmentOptions) ([]*segment, error) {
+	// Expired cells are not written at all
+	now := time.Now().UnixNano()
+	live := make([]YDBColumn, 0, rows.len())
+	keys := make([]string, 0, rows.len())
+	it := rows.iterator()
+	for it.seek(""); it.valid(); it.next() {
+		row, _ := it.row()
+		col := newYDBColumn()
+		col.merge(row)
+		col.dropExpired(now, options.familyTTL)
+		if !col.empty() {
+			live = append(live, col)
+			keys = append(keys, it.key())
+		}
+	}
+
+	segments := make([]*segment, 0, len(families))
+	segmentKeys := make([][]string, 0, len(families))
+	segmentLocs := make([][]rowLocation, 0, len(families))
+	abort := func() {
+		for _, seg := range segments {
+			seg.close()
+			os.Remove(seg.path)
+		}
+	}
+	for i, family := range families {
+		partKeys := make([]string, 0)
+		parts := make([]YDBColumn, 0)
+		for j, col := range live {
+			if part := col.family(family); !part.empty() {
+				partKeys = append(partKeys, keys[j])
+				parts = append(parts, part)
 			}
-		} else {
-			return err
 		}
+		if len(partKeys) == 0 {
+			continue
+		}
+		segID := id + uint64(i)
+		seg, locs, err := table.writeSegmentFile(ydb, segmentMeta{ID: segID, Seq: segID, Family: family}, partKeys, parts, options)
+		if err != nil {
+			abort()
+			return nil, err
+		}
+		segments = append(segments, seg)
+		segmentKeys = append(segmentKeys, partKeys)
+		segmentLocs = append(segmentLocs, locs)
+	}
+	if len(segments) == 0 {
+		return nil, nil
 	}
 
+	err := ydb.indexDB.Update(func(tx *bbolt.Tx) error {
+		segmentsBucket, rowIndex, err := createTableBuckets(tx, table.metadata.TableName)
+		if err != nil {
+			return err
+		}
+		for i, seg := range segments {
+			v, err := json.Marshal(seg.meta)
+			if err != nil {
+				return err
+			}
+			if err := segmentsBucket.Put(segmentKey(seg.meta.ID), v); err != nil {
+				return err
+			}
+			if err := indexRows(rowIndex, segmentKeys[i], segmentLocs[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		abort()
+		return nil, err
+	}
+	return segments, nil
+}
 
+// writeSegmentFile writes rows under keys into the segment file of meta and
+// opens it. It returns where every row is.
+func (table *ydbTable) writeSegmentFile(ydb *ydbServer, meta segmentMeta, keys []string, rows []YDBColumn, options segmentOptions) (*segment, []rowLocation, error) {
+	path := tableSegmentName(table.metadata.TableName, meta.ID)
+	w, err := newSegmentWriter(path, meta, options.falsePositive(), options.familyCompression(meta.Family))
+	if err != nil {
+		return nil, nil, err
+	}
+	locs := make([]rowLocation, 0, len(keys))
+	for i, key := range keys {
+		loc, err := w.add(key, rows[i].encode())
+		if err != nil {
+			w.abort()
+			return nil, nil, err
+		}
+		locs = append(locs, loc)
+	}
+	meta, err = w.finish()
+	if err != nil {
+		w.abort()
+		return nil, nil, err
+	}
+	seg, err := openSegment(path, meta, ydb.blockCache)
+	if err != nil {
+		os.Remove(path)
+		return nil, nil, err
+	}
+	return seg, locs, nil
 }
 
-func (table *ydbTable) flush(ydb *ydbServer) error {
-	f, err := os.OpenFile(table.filePath(), os.O_RDWR|os.O_CREATE, 0755)
+// loadSegments opens every segment listed for the table in the index db.
+func (table *ydbTable) loadSegments(ydb *ydbServer) error {
+	metas := make([]segmentMeta, 0)
+	err := ydb.indexDB.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(table.metadata.TableName))
+		if b == nil {
+			return nil
+		}
+		segments := b.Bucket(segmentBucket)
+		if segments == nil {
+			return nil
+		}
+		return segments.ForEach(func(k, v []byte) error {
+			var meta segmentMeta
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			metas = append(metas, meta)
+			return nil
+		})
+	})
 	if err != nil {
-		fmt.Println("Open file error")
-		log.Fatal(err)
 		return err
 	}
-	//if err := f.Close(); err != nil {
-	//	log.Fatal(err)
-	//	return err
-	//}
-	countLine, err := lineCounter(bufio.NewReader(f))
-	f.Close()
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].Seq < metas[j].Seq
+	})
 
-	db := ydb.indexDB
-	f, err = os.OpenFile(table.filePath(), os.O_APPEND|os.O_WRONLY, 0755)
+	for _, meta := range metas {
+		seg, err := openSegment(tableSegmentName(table.metadata.TableName, meta.ID), meta, ydb.blockCache)
+		if err != nil {
+			return err
+		}
+		table.segments = append(table.segments, seg)
+		if meta.ID >= table.nextSegmentID {
+			table.nextSegmentID = meta.ID + 1
+		}
+	}
+	table.removeOrphanSegments()
+	return nil
+}
+
+// importLegacyData moves rows of the old line based <table>.ydb file into
+// segments and removes the file.
+func (table *ydbTable) importLegacyData(ydb *ydbServer) error {
+	_, tableDataFilename := formatFilename(table.metadata.TableName)
+	f, err := os.Open(tableDataFilename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 	defer f.Close()
+
+	// The old line number index lives directly in the table bucket.
+	err = ydb.indexDB.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(table.metadata.TableName)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(table.metadata.TableName))
+	})
 	if err != nil {
-		fmt.Println("Open file error")
-		log.Fatal(err)
-	}
-	//if err := f.Close(); err != nil {
-	//	log.Fatal(err)
-	//}
-	//w := bufio.NewWriter(f)
-	// Here we append the memTable into the file:
-	// RowKey, {"a:b": "1", "c:d": "2"}
-	for key, value := range table.data {
-		db.Batch(func(tx *bbolt.Tx) error {
-			b := tx.Bucket([]byte(table.metadata.TableName))
-			if b == nil {
-				b, err = tx.CreateBucket([]byte(table.metadata.TableName))
-			}
-			v := b.Get([]byte(key))
-			lines := make([]int, 0)
-			if v != nil {
-				json.Unmarshal(v, &lines)
+		return err
+	}
+
+	// Lines are in write order, so later lines get newer timestamps.
+	rows := newMemTable()
+	reader := bufio.NewReader(f)
+	for lineNo := uint64(0); ; lineNo++ {
+		line, err := reader.ReadString(byte('\n'))
+		parts := strings.SplitN(strings.TrimSuffix(line, "\n"), "|", 2)
+		if len(parts) == 2 {
+			if col, err := decodeLegacyRow([]byte(parts[1]), lineNo); err == nil {
+				rows.update(parts[0], func(row *YDBColumn) {
+					row.merge(col)
+				})
 			}
-			lines = append(lines, countLine)
-			v, err = json.Marshal(lines)
-			if err != nil {
-				fmt.Println("Marshal error")
-				log.Fatal(err)
+		}
+		if rows.size() > table.metadata.MemTableLimit || (err == io.EOF && rows.len() > 0) {
+			if err := table.writeSegments(ydb, rows); err != nil {
 				return err
 			}
-			b.Put([]byte(key), v)
-			return nil
-		})
-		line := key + "|" + value.toString()
-		if _, err := f.WriteString(line + "\n"); err != nil {
-			panic(err)
+			rows = newMemTable()
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
 		}
-		countLine ++
-		//fmt.Fprintln(w, line)
 	}
 
-	if wal, err := os.OpenFile(table.walPath(), os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0666); err == nil {
-		defer wal.Close()
-		if _, err = wal.WriteString("cp\n"); err != nil {
-			panic(err)
+	f.Close()
+	return os.Remove(tableDataFilename)
+}
+
+// close syncs the WAL and releases the files of the table.
+func (table *ydbTable) close() {
+	table.closeWAL()
+	for _, seg := range table.segments {
+		seg.release()
+	}
+	table.segments = nil
+}
+
+// alter changes the column families and the options of the table as args
+// asks and saves the metadata. The data of dropped families is flushed out
+// of the memtables and deleted. Compaction must be stopped.
+func (table *ydbTable) alter(ydb *ydbServer, args *ydbserverrpc.AlterTableArgs) error {
+	table.dataLocker.Lock()
+	defer table.dataLocker.Unlock()
+
+	// Every family is named once, new ones must not exist and the others must
+	added := make([]string, 0, len(args.AddFamilies))
+	for family, options := range args.AddFamilies {
+		if !validFamily(family) || !validFamilyOptions(options) || table.hasFamily(family) {
+			return errInvalidFamilies
+		}
+		added = append(added, family)
+	}
+	dropped := make(map[string]bool)
+	for _, family := range args.DropFamilies {
+		if _, ok := args.AddFamilies[family]; ok || dropped[family] {
+			return errInvalidFamilies
 		}
-		if err = wal.Sync(); err != nil {
-			panic(err)
+		if !table.hasFamily(family) {
+			return errUnknownFamily
 		}
+		dropped[family] = true
+	}
+	for family, options := range args.FamilyOptions {
+		if _, ok := args.AddFamilies[family]; ok || dropped[family] || !validFamilyOptions(options) {
+			return errInvalidFamilies
+		}
+		if !table.hasFamily(family) {
+			return errUnknownFamily
+		}
+	}
+	if args.Options != nil && !validTableOptions(*args.Options) {
+		return errInvalidFamilies
 	}
 
-	table.data = make(map[string]YDBColumn)
-	f.Sync()
+	old := table.metadata
+	metadata := table.metadata
+	metadata.ColumnsFamilies = make([]string, 0, len(old.ColumnsFamilies)+len(added))
+	for _, family := range old.ColumnsFamilies {
+		if !dropped[family] {
+			metadata.ColumnsFamilies = append(metadata.ColumnsFamilies, family)
+		}
+	}
+	sort.Strings(added)
+	metadata.ColumnsFamilies = append(metadata.ColumnsFamilies, added...)
+	metadata.FamilyOptions = make(map[string]ydbserverrpc.ColumnFamilyOptions)
+	for family, options := range old.FamilyOptions {
+		if !dropped[family] {
+			metadata.FamilyOptions[family] = options
+		}
+	}
+	for family, options := range args.AddFamilies {
+		metadata.FamilyOptions[family] = options
+	}
+	for family, options := range args.FamilyOptions {
+		metadata.FamilyOptions[family] = options
+	}
+	if args.Options != nil {
+		metadata.setOptions(*args.Options)
+	}
+	table.metadata = metadata
+	if err := table.applyOptions(old); err != nil {
+		table.metadata = old
+		return err
+	}
+
+	// Writes to dropped families are refused from now on, what the memtables
+	// hold of them is flushed into the segments deleted next
+	if len(dropped) > 0 {
+		if err := table.flush(ydb); err != nil {
+			table.metadata = old
+			return err
+		}
+		if err := table.dropFamilies(ydb, dropped); err != nil {
+			table.metadata = old
+			return err
+		}
+	}
+	return table.saveMetadata()
+}
+
+// configure sets the options of the table and saves them. Compaction must
+// be stopped.
+func (table *ydbTable) configure(options ydbserverrpc.TableOptions) error {
+	table.dataLocker.Lock()
+	defer table.dataLocker.Unlock()
+
+	old := table.metadata
+	table.metadata.setOptions(options)
+	if err := table.applyOptions(old); err != nil {
+		table.metadata = old
+		return err
+	}
+	return table.saveMetadata()
+}
+
+// applyOptions puts the options of the metadata, changed from old, to work
+// on the open table. Most are read where they are used, the WAL writer and
+// the memtable budget need a hand. Needs the table lock.
+func (table *ydbTable) applyOptions(old TableMeta) error {
+	// The WAL writer reads its options once, a new one takes the changes
+	metadata := table.metadata
+	if metadata.WALSyncPolicy != old.WALSyncPolicy || metadata.WALSyncInterval != old.WALSyncInterval || metadata.WALSegmentSize != old.WALSegmentSize {
+		if err := table.restartWAL(); err != nil {
+			return err
+		}
+	}
+	// A memtable over the new budget is flushed right away
+	if table.data.size() > metadata.MemTableLimit {
+		return table.freeze()
+	}
 	return nil
 }
 
-func (table *ydbTable) PutRow(ydb *ydbServer, rowKey string, updated map[string]string) error {
-	if _, ok := table.data[rowKey]; !ok {
-		table.data[rowKey] = YDBColumn{
-			Columns: make(map[string]string),
+// dropFamilies deletes the segments of families and rewrites the segments
+// holding every family without them. Needs the table lock, with compaction
+// stopped.
+func (table *ydbTable) dropFamilies(ydb *ydbServer, families map[string]bool) error {
+	replaced := make(map[uint64]bool)
+	rewritten := make(map[uint64]*segment) // Replaced segment ID -> rewrite
+	outputs := make([]*segment, 0)
+	outputKeys := make([][]string, 0)
+	outputLocs := make([][]rowLocation, 0)
+	dropped := make([]string, 0)
+	abort := func() {
+		for _, seg := range outputs {
+			seg.close()
+			os.Remove(seg.path)
 		}
 	}
+	for _, seg := range table.segments {
+		if !families[seg.meta.Family] && seg.meta.Family != "" {
+			continue
+		}
+		keys := make([]string, 0)
+		rows := make([]YDBColumn, 0)
+		it := seg.iterator()
+		for it.seek(""); it.valid(); it.next() {
+			col, err := it.row()
+			if err != nil {
+				abort()
+				return err
+			}
+			col.dropFamilies(families)
+			if seg.meta.Family != "" || col.empty() {
+				dropped = append(dropped, it.key())
+				continue
+			}
+			keys = append(keys, it.key())
+			rows = append(rows, col)
+		}
+		if err := it.err(); err != nil {
+			abort()
+			return err
+		}
+		replaced[seg.meta.ID] = true
+		if len(keys) == 0 {
+			continue
+		}
+		id := table.nextSegmentID
+		table.nextSegmentID++
+		output, locs, err := table.writeSegmentFile(ydb, segmentMeta{ID: id, Seq: seg.meta.Seq}, keys, rows, table.metadata.segmentOptions())
+		if err != nil {
+			abort()
+			return err
+		}
+		rewritten[seg.meta.ID] = output
+		outputs = append(outputs, output)
+		outputKeys = append(outputKeys, keys)
+		outputLocs = append(outputLocs, locs)
+	}
+	if len(replaced) == 0 {
+		return nil
+	}
 
-	if wal, err := os.OpenFile(table.walPath(), os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0666); err == nil {
-		defer wal.Close()
-		for key, value := range updated {
-			if _, err := wal.WriteString(rowKey + "|" + key + "|" + value + "\n"); err != nil {
-				panic(err)
+	err := ydb.indexDB.Update(func(tx *bbolt.Tx) error {
+		segmentsBucket, rowIndex, err := createTableBuckets(tx, table.metadata.TableName)
+		if err != nil {
+			return err
+		}
+		for id := range replaced {
+			if err := segmentsBucket.Delete(segmentKey(id)); err != nil {
+				return err
 			}
 		}
-		if err := wal.Sync(); err != nil {
-			panic(err)
+		if err := unindexRows(rowIndex, dropped, replaced); err != nil {
+			return err
 		}
+		for i, seg := range outputs {
+			v, err := json.Marshal(seg.meta)
+			if err != nil {
+				return err
+			}
+			if err := segmentsBucket.Put(segmentKey(seg.meta.ID), v); err != nil {
+				return err
+			}
+			if err := indexRows(rowIndex, outputKeys[i], outputLocs[i], replaced); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		abort()
+		return err
+	}
 
+	segments := make([]*segment, 0, len(table.segments))
+	for _, seg := range table.segments {
+		if !replaced[seg.meta.ID] {
+			segments = append(segments, seg)
+			continue
+		}
+		if output, ok := rewritten[seg.meta.ID]; ok {
+			segments = append(segments, output)
+		}
+		seg.retire()
 	}
+	table.segments = segments
+	return nil
+}
+
+// saveMetadata writes the metadata of the table to its .meta file. Needs the
+// table lock.
+func (table *ydbTable) saveMetadata() error {
+	tableMetaFilename, _ := formatFilename(table.metadata.TableName)
+	return writeGob(tableMetaFilename, table.metadata)
+}
 
+// PutRow writes a version of every updated column, at timestamp or at a
+// server timestamp when it is 0. A cell with a ttl expires that long after
+// its timestamp. Columns must belong to declared families.
+func (table *ydbTable) PutRow(ydb *ydbServer, rowKey string, updated map[string][]byte, timestamp int64, ttl time.Duration) error {
+	table.dataLocker.Lock()
+
+	for key := range updated {
+		if !table.hasFamily(columnFamily(key)) {
+			table.dataLocker.Unlock()
+			return errUnknownFamily
+		}
+	}
+	timestamp = table.timestamp(timestamp)
+	var expireAt int64
+	if ttl > 0 {
+		expireAt = timestamp + int64(ttl)
+	}
+	rec := walRecord{
+		op:        walOpPut,
+		rowKey:    rowKey,
+		timestamp: timestamp,
+		expireAt:  expireAt,
+	}
 	for key, value := range updated {
-		table.data[rowKey].Columns[key] = value
+		rec.keys = append(rec.keys, key)
+		rec.values = append(rec.values, value)
 	}
-	if len(table.data) > table.metadata.MemTableLimit {
-		table.flush(ydb)
+	c := table.apply(ydb, rec)
+	table.dataLocker.Unlock()
+
+	return c.wait()
+}
+
+// apply queues rec in the WAL and applies it to the memtable, freezing the
+// memtable for a flush when it is full. The caller waits for the commit after
+// releasing the table lock, so concurrent writers share WAL syncs. Readers may
+// see the record before it is durable.
+func (table *ydbTable) apply(ydb *ydbServer, rec walRecord) *walCommit {
+	c := table.wal.append([]walRecord{rec})
+	table.applyWALRecord(rec)
+	if table.data.size() > table.metadata.MemTableLimit {
+		// The record is in the WAL already, so a failed flush does not fail
+		// it. The flush is tried again and the next full memtable waits.
+		if err := table.freeze(); err != nil {
+			fmt.Println("Flush of table "+table.metadata.TableName+": ", err)
+		}
 	}
-	return nil
+	return c
+}
+
+// applyPut adds a cell version to the memtable.
+func (table *ydbTable) applyPut(rowKey string, key string, cell YDBCell) {
+	table.data.update(rowKey, func(col *YDBColumn) {
+		col.put(key, cell)
+		col.trimVersions(table.maxVersions)
+	})
 }
 
-func (table *ydbTable) GetRowHelper(ydb *ydbServer, rowKey string) YDBColumn {
-	// TODO: get record
-	col, ok := table.data[rowKey]
-	if !ok {
-		col = YDBColumn{
-			Columns: make(map[string]string),
+// Delete writes tombstones for a row, hiding the versions up to timestamp or
+// up to a server timestamp when it is 0. Targets are family:qualifier names
+// for walDeleteColumn and family names for walDeleteFamily, of declared
+// families, walDeleteRow needs none.
+func (table *ydbTable) Delete(ydb *ydbServer, rowKey string, kind string, targets []string, timestamp int64) error {
+	table.dataLocker.Lock()
+
+	for _, target := range targets {
+		family := target
+		if kind == walDeleteColumn {
+			family = columnFamily(target)
+		}
+		if !table.hasFamily(family) {
+			table.dataLocker.Unlock()
+			return errUnknownFamily
 		}
 	}
+	if kind == walDeleteRow {
+		targets = []string{""}
+	}
+	timestamp = table.timestamp(timestamp)
+	rec := walRecord{
+		op:        walOpDelete,
+		rowKey:    rowKey,
+		timestamp: timestamp,
+		kind:      kind,
+		keys:      targets,
+	}
+	c := table.apply(ydb, rec)
+	table.dataLocker.Unlock()
 
-	// Get column from file line by line, merge them
-	db := ydb.indexDB
-	f, err := os.Open(table.filePath())
-	if err != nil {
-		log.Fatal(err)
-		return col
+	return c.wait()
+}
+
+// applyDelete records a tombstone in the memtable.
+func (table *ydbTable) applyDelete(rowKey string, kind string, target string, timestamp int64) {
+	table.data.update(rowKey, func(col *YDBColumn) {
+		switch kind {
+		case walDeleteRow:
+			col.deleteRow(timestamp)
+		case walDeleteFamily:
+			col.deleteFamily(target, timestamp)
+		case walDeleteColumn:
+			col.deleteColumn(target, timestamp)
+		}
+	})
+}
+
+// mergeMemtables merges the columns in set of the copies of a row in the
+// frozen and in the live memtable into col.
+func (table *ydbTable) mergeMemtables(col *YDBColumn, rowKey string, set columnSet) {
+	if table.immutable != nil {
+		if memCol, ok := table.immutable.get(rowKey); ok {
+			col.mergeColumns(memCol, set)
+		}
 	}
-	defer f.Close()
-	reader := bufio.NewReader(f)
-	err = db.View(func(tx *bbolt.Tx) error {
+	if memCol, ok := table.data.get(rowKey); ok {
+		col.mergeColumns(memCol, set)
+	}
+}
+
+// GetRowHelper merges the columns in set of every copy of a row, from the
+// oldest segment to the memtables, and hides the expired cells.
+func (table *ydbTable) GetRowHelper(ydb *ydbServer, rowKey string, set columnSet) (YDBColumn, error) {
+	col := newYDBColumn()
+
+	// Rows ruled out by every bloom filter need no disk access at all, nor do
+	// the segments of families left out of set
+	candidates := make([]*segment, 0)
+	for _, seg := range table.segments {
+		if seg.holds(set) && seg.mayContain(rowKey) {
+			candidates = append(candidates, seg)
+		}
+	}
+	if len(candidates) == 0 {
+		table.mergeMemtables(&col, rowKey, set)
+		col.dropExpired(time.Now().UnixNano(), table.ttl)
+		return col, nil
+	}
+
+	// The row index holds the exact place of every record of the row
+	locs := make(map[uint64][]rowLocation)
+	err := ydb.indexDB.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(table.metadata.TableName))
 		if b == nil {
 			return nil
 		}
-		v := b.Get([]byte(rowKey))
-		lines := make([]int, 0)
-		json.Unmarshal(v, &lines)
-		sort.Ints(lines)
-		cnt := 0
-		for _, l := range lines {
-			for cnt != l {
-				reader.ReadString(byte('\n'))
-				cnt += 1
-			}
-			line, err := reader.ReadString(byte('\n'))
+		rowIndex := b.Bucket(rowIndexBucket)
+		if rowIndex == nil {
+			return nil
+		}
+		if v := rowIndex.Get([]byte(rowKey)); v != nil {
+			rowLocs, err := decodeRowLocations(v)
 			if err != nil {
 				return err
 			}
-			parts := strings.Split(line, "|")
-			var anotherCol YDBColumn
-			json.Unmarshal([]byte(parts[1]), &anotherCol)
-			col.merge(anotherCol)
-			cnt += 1
+			for _, loc := range rowLocs {
+				locs[loc.Segment] = append(locs[loc.Segment], loc)
+			}
 		}
 		return nil
 	})
-	return col
+	if err != nil {
+		return col, err
+	}
+
+	for _, seg := range candidates {
+		for _, loc := range locs[seg.meta.ID] {
+			v, ok, err := seg.readRecord(rowKey, loc)
+			if err != nil {
+				return col, err
+			}
+			if !ok {
+				continue
+			}
+			anotherCol, err := decodeRow(v)
+			if err != nil {
+				return col, err
+			}
+			col.mergeColumns(anotherCol, set)
+		}
+	}
+
+	table.mergeMemtables(&col, rowKey, set)
+	col.dropExpired(time.Now().UnixNano(), table.ttl)
+	return col, nil
 }
 
-func (table *ydbTable) GetRow(ydb *ydbServer, rowKey string) string {
-	col := table.GetRowHelper(ydb, rowKey)
-	ret, err := json.Marshal(col.Columns)
+// encodeRow builds the reply of a row from its projected versions: the cells
+// and, for older clients, the newest value of every column as JSON and all
+// the versions as JSON when r asks for them.
+func encodeRow(rowKey string, versions map[string][]YDBCell, r versionRange) (ydbserverrpc.ScanRow, error) {
+	encoded := ydbserverrpc.ScanRow{RowKey: rowKey, Cells: replyCells(versions)}
+	row, err := json.Marshal(latestValues(versions))
+	if err != nil {
+		return encoded, err
+	}
+	encoded.Row = string(row)
+	if r.maxVersions == 0 {
+		return encoded, nil
+	}
+	cells, err := json.Marshal(jsonVersions(versions))
 	if err != nil {
-		log.Fatal(err)
-		return ""
+		return encoded, err
 	}
-	return string(ret)
+	encoded.Versions = string(cells)
+	return encoded, nil
 }
 
-func (table *ydbTable) GetRows(ydb *ydbServer, startRowKey string, endRowKey string) map[string]string {
-	values := make(map[string]string)
-	db := ydb.indexDB
-	db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(table.metadata.TableName))
-		if b == nil {
-			return nil
+// replyCells lists the versions by family and qualifier, newest first.
+func replyCells(versions map[string][]YDBCell) []ydbserverrpc.Cell {
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	cells := make([]ydbserverrpc.Cell, 0, len(keys))
+	for _, key := range keys {
+		family := columnFamily(key)
+		qualifier := key[strings.Index(key, ":")+1:]
+		for _, cell := range versions[key] {
+			cells = append(cells, ydbserverrpc.Cell{
+				Family:    family,
+				Qualifier: qualifier,
+				Value:     cell.Value,
+				Timestamp: cell.Timestamp,
+			})
 		}
-		c := b.Cursor()
-		if c == nil {
-			return nil
+	}
+	return cells
+}
+
+// cellsSize returns the bytes of the names and values of cells.
+func cellsSize(cells []ydbserverrpc.Cell) int64 {
+	var size int64
+	for _, cell := range cells {
+		size += int64(len(cell.Family)+len(cell.Qualifier)+len(cell.Value)) + 8
+	}
+	return size
+}
+
+// GetRow returns the columns in set of a row, with the versions r asks for.
+func (table *ydbTable) GetRow(ydb *ydbServer, rowKey string, r versionRange, set columnSet) (ydbserverrpc.ScanRow, error) {
+	table.dataLocker.RLock()
+	defer table.dataLocker.RUnlock()
+
+	col, err := table.GetRowHelper(ydb, rowKey, set)
+	if err != nil {
+		return ydbserverrpc.ScanRow{}, err
+	}
+	return encodeRow(rowKey, col.project(r, table.maxVersions), r)
+}
+
+// rowIterator returns an iterator merging the columns in set of every copy
+// of the rows, from the oldest segment holding them to the live memtable. Needs the table
+// read lock while it is used.
+func (table *ydbTable) rowIterator(set columnSet) rowIterator {
+	children := make([]rowIterator, 0, len(table.segments)+2)
+	for _, seg := range table.segments {
+		if seg.holds(set) {
+			children = append(children, seg.iterator())
+		}
+	}
+	if table.immutable != nil {
+		children = append(children, table.immutable.iterator())
+	}
+	children = append(children, table.data.iterator())
+	it := newMergeIterator(children)
+	it.columns = set
+	return it
+}
+
+// GetRows merges the columns in set of the segments and the memtables in key
+// order. Rows with no version in r, or filtered out by filter, are left out.
+func (table *ydbTable) GetRows(ydb *ydbServer, startRowKey string, endRowKey string, r versionRange, set columnSet, filter rowFilter) ([]ydbserverrpc.ScanRow, error) {
+	table.dataLocker.RLock()
+	defer table.dataLocker.RUnlock()
+
+	rows := make([]ydbserverrpc.ScanRow, 0)
+	now := time.Now().UnixNano()
+	it := table.rowIterator(set)
+	for it.seek(startRowKey); it.valid() && it.key() <= endRowKey; it.next() {
+		col, err := it.row()
+		if err != nil {
+			return nil, err
 		}
-		min := []byte(startRowKey)
-		max := []byte(endRowKey)
-		for k, _ := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0; k, _ = c.Next() {
-			col := table.GetRowHelper(ydb, string(k))
-			val, _ := json.Marshal(col.Columns)
-			values[string(k)] = string(val)
-			//cols = append(cols, col)
+		col.dropExpired(now, table.ttl)
+		versions := col.project(r, table.maxVersions)
+		if filter != nil && len(versions) > 0 {
+			versions = filter.filter(it.key(), versions)
 		}
-		return nil
-	})
-	return values
+		if len(versions) == 0 {
+			// Deleted or filtered out row
+			continue
+		}
+		row, err := encodeRow(it.key(), versions, r)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// scanOptions selects the rows of a Scan page.
+type scanOptions struct {
+	start     string    // First row key, "" for none
+	end       string    // Last row key, inclusive, "" for none
+	prefix    string    // Row key prefix, "" for none
+	reverse   bool      // From the end of the range backwards
+	resume    bool      // Continue after the row key in after
+	after     string    // Last row key of the previous page
+	limit     int       // Max rows
+	byteLimit int64     // Max bytes of keys and rows, the first row is returned anyway
+	columns   columnSet // Columns read, nil for all
+	filter    rowFilter // Rows and columns returned, nil for all
+}
+
+// seekKey returns where the scan starts, the start key of the range or, in
+// reverse, its end key, "" for the first or the last row.
+func (o *scanOptions) seekKey() string {
+	if !o.reverse {
+		key := o.start
+		if o.prefix > key {
+			key = o.prefix
+		}
+		if o.resume && o.after > key {
+			key = o.after
+		}
+		return key
+	}
+	key := o.end
+	bounds := []string{prefixSuccessor(o.prefix)}
+	if o.resume {
+		bounds = append(bounds, o.after)
+	}
+	for _, bound := range bounds {
+		if bound != "" && (key == "" || bound < key) {
+			key = bound
+		}
+	}
+	return key
+}
+
+// before tells whether the scan has not reached the range at key yet.
+func (o *scanOptions) before(key string) bool {
+	if o.resume && (key == o.after || (key > o.after) == o.reverse) {
+		return true
+	}
+	if !o.reverse {
+		return false
+	}
+	return (o.end != "" && key > o.end) || (key > o.prefix && !strings.HasPrefix(key, o.prefix))
+}
+
+// past tells whether the scan left the range at key.
+func (o *scanOptions) past(key string) bool {
+	if o.reverse {
+		return key < o.start || key < o.prefix
+	}
+	return (o.end != "" && key > o.end) || !strings.HasPrefix(key, o.prefix)
 }
 
-func (table *ydbTable) GetColumnByRow(ydb *ydbServer, rowKey string, cf string) string {
-	col := table.GetRowHelper(ydb, rowKey)
-	if value, ok := col.Columns[cf]; ok {
-		return value
+// prefixSuccessor returns the smallest key greater than every key starting
+// with prefix, "" when there is none.
+func prefixSuccessor(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
 	}
 	return ""
 }
+
+// Scan returns a page of the rows selected by o, in key order or in reverse,
+// and whether rows of the range are left after it.
+func (table *ydbTable) Scan(ydb *ydbServer, o scanOptions, r versionRange) ([]ydbserverrpc.ScanRow, bool, error) {
+	table.dataLocker.RLock()
+	defer table.dataLocker.RUnlock()
+
+	it := table.rowIterator(o.columns)
+	if o.reverse {
+		it.seekReverse(o.seekKey())
+	} else {
+		it.seek(o.seekKey())
+	}
+	return table.readPage(it, o, r)
+}
+
+// readPage reads the rows of a page from the position of it on and leaves it
+// at the first row of the next page. Needs the table read lock.
+func (table *ydbTable) readPage(it rowIterator, o scanOptions, r versionRange) ([]ydbserverrpc.ScanRow, bool, error) {
+	rows := make([]ydbserverrpc.ScanRow, 0)
+	var size int64
+	now := time.Now().UnixNano()
+	for ; it.valid(); it.next() {
+		if o.before(it.key()) {
+			continue
+		}
+		if o.past(it.key()) {
+			break
+		}
+		col, err := it.row()
+		if err != nil {
+			return nil, false, err
+		}
+		col.dropExpired(now, table.ttl)
+		versions := col.project(r, table.maxVersions)
+		if o.filter != nil && len(versions) > 0 {
+			versions = o.filter.filter(it.key(), versions)
+		}
+		if len(versions) == 0 {
+			// Deleted or filtered out row
+			continue
+		}
+		if len(rows) == o.limit {
+			return rows, true, nil
+		}
+		row, err := encodeRow(it.key(), versions, r)
+		if err != nil {
+			return nil, false, err
+		}
+		rowSize := int64(len(row.RowKey)+len(row.Row)+len(row.Versions)) + cellsSize(row.Cells)
+		if len(rows) > 0 && size+rowSize > o.byteLimit {
+			return rows, true, nil
+		}
+		size += rowSize
+		rows = append(rows, row)
+	}
+	if err := it.err(); err != nil {
+		return nil, false, err
+	}
+	return rows, false, nil
+}
+
+func (table *ydbTable) GetColumnByRow(ydb *ydbServer, rowKey string, cf string) ([]byte, error) {
+	table.dataLocker.RLock()
+	defer table.dataLocker.RUnlock()
+
+	col, err := table.GetRowHelper(ydb, rowKey, columnSet{cf: true})
+	if err != nil {
+		return nil, err
+	}
+	if cells, ok := col.Columns[cf]; ok {
+		return cells[0].Value, nil
+	}
+	return nil, nil
+}
@@ -12,13 +12,62 @@ const (
 	TableOpenByOther                   // Table opened by others
 	WrongServer                        // The specified table does not fall in the server's hash range.
 	NotReady                           // The servers are still getting ready.
+	InvalidArgument                    // An argument of the request is out of range.
+	ScannerNotFound                    // The scanner was closed or its lease expired.
+	UnknownFamily                      // A column family is not declared by the table.
+	NodeUnavailable                    // Another node could not be reached or failed the call.
 )
 
+// FilterType selects what a Filter tests.
+type FilterType int
+
+const (
+	FilterRowPrefix       FilterType = iota + 1 // Rows whose key starts with Value
+	FilterRowRegex                              // Rows whose key matches the regular expression Value
+	FilterColumnValue                           // Rows whose newest value of Column compares to Value by Op
+	FilterQualifierPrefix                       // Columns whose qualifier starts with Value
+	FilterFamily                                // Columns of the family Value
+	FilterFirstKeyOnly                          // The first column of every row
+	FilterPage                                  // The first Limit rows
+	FilterAnd                                   // What passes every filter of Filters, in order
+	FilterOr                                    // What passes any filter of Filters
+)
+
+// CompareOp compares a column value with the value of a filter.
+type CompareOp int
+
+const (
+	Equal CompareOp = iota
+	NotEqual
+	Less
+	LessOrEqual
+	Greater
+	GreaterOrEqual
+)
+
+// Filter selects rows and columns on the server. Rows filtered out, and rows
+// left without columns, are not returned.
+type Filter struct {
+	Type    FilterType
+	Value   string    // Prefix, regular expression, family or value compared byte-wise
+	Column  string    // Column family:qualifier of FilterColumnValue
+	Op      CompareOp // Comparison of FilterColumnValue
+	Limit   int       // Rows passed by FilterPage
+	Filters []Filter  // Operands of FilterAnd and FilterOr
+}
+
 type ServerNode struct {
 	HostPort string // The host:port address of the server node.
 	NodeID   uint32 // The ID identifying this server node.
 }
 
+// NodeStatus is the reply of another node to a call passed on to it.
+type NodeStatus struct {
+	Node   ServerNode
+	Status Status // NodeUnavailable when the node could not be reached
+	Error  string // Why the node could not be reached
+}
+
 type RegisterServerArgs struct {
 	ServerInfo ServerNode
 }
@@ -37,16 +86,73 @@ type GetServersReply struct {
 	Servers []ServerNode
 }
 
+// SyncPolicy selects when WAL writes are synced to disk.
+type SyncPolicy int
+
+const (
+	SyncGroup      SyncPolicy = iota // Concurrent writes share one sync, the default.
+	SyncEveryWrite                   // Every write is synced on its own.
+	SyncInterval                     // Writes are synced periodically and acknowledged before.
+)
+
+// Compression selects the codec of flushed data blocks.
+type Compression int
+
+const (
+	CompressionNone  Compression = iota // Blocks are stored as they are, the default.
+	CompressionFlate                    // DEFLATE, compress/flate.
+	CompressionGzip                     // DEFLATE in gzip framing, compress/gzip.
+	CompressionZlib                     // DEFLATE in zlib framing, compress/zlib.
+)
+
+// CompactionStrategy selects how the segments of a table are compacted.
+type CompactionStrategy int
+
+const (
+	CompactionSizeTiered CompactionStrategy = iota // Runs of segments of similar size are merged in the background, the default.
+	CompactionManual                               // Segments are merged by CompactTable only.
+)
+
+// TableOptions configures a table. Zero fields take the defaults. The cell
+// options apply to the families without options of their own.
+type TableOptions struct {
+	MemTableLimit         int64              // Memtable budget in bytes, 0 for default (4MB)
+	WALSyncPolicy         SyncPolicy         // When WAL writes are synced
+	WALSyncInterval       time.Duration      // Sync period of SyncInterval, 0 for default (100ms)
+	WALSegmentSize        int64              // Size at which the WAL moves to a new file, 0 for default (16MB)
+	Compression           Compression        // Codec of the flushed data
+	BloomFalsePositive    float64            // False positive rate of bloom filters in (0, 1), 0 for default (1%)
+	MaxVersions           int                // Versions kept per cell, 0 for default (1)
+	TTL                   time.Duration      // Lifetime of cells counted from their timestamp, 0 for ever
+	Compaction            CompactionStrategy // How segments are compacted
+	CompactionMinSegments int                // Shortest run merged by size-tiered compaction, 0 for default (4)
+}
+
+// ColumnFamilyOptions configures a column family. Zero fields take the
+// options of the table, HasTTL and HasCompression set a zero TTL or
+// CompressionNone for the family.
+type ColumnFamilyOptions struct {
+	MaxVersions    int           // Versions kept per cell, 0 for the table's
+	TTL            time.Duration // Lifetime of cells counted from their timestamp, 0 for the table's
+	Compression    Compression   // Codec of the flushed data of the family
+	HasTTL         bool          // TTL is set, 0 keeps cells for ever
+	HasCompression bool          // Compression is set, CompressionNone included
+}
+
 type TableHandle struct {
 	TableName      string
 	ColumnFamilies []string
-	MemTableLimit  int
+	FamilyOptions  map[string]ColumnFamilyOptions
+	Options        TableOptions
+	MemTableLimit  int64 // Memtable budget in bytes
 	CreationTime   time.Time
 }
 
 type CreateTableArgs struct {
-	TableName      string
+	TableName      string // Name without "." and "/"
 	ColumnFamilies []string
+	FamilyOptions  map[string]ColumnFamilyOptions // Column family -> options, may be nil
+	Options        TableOptions
 }
 
 type CreateTableReply struct {
@@ -79,35 +185,178 @@ type DestroyTableReply struct {
 	Status Status
 }
 
+// AlterTableArgs changes the column families and the options of an open
+// table. A family may appear in one of the fields only.
+type AlterTableArgs struct {
+	TableName     string
+	AddFamilies   map[string]ColumnFamilyOptions // New column families -> options
+	DropFamilies  []string                       // Column families removed with their data
+	FamilyOptions map[string]ColumnFamilyOptions // Column families kept -> new options
+	Options       *TableOptions                  // New table options, nil to keep them
+}
+
+type AlterTableReply struct {
+	TableHandle TableHandle
+	Status      Status
+}
+
 type PutRowArgs struct {
 	TableName      string
-	RowKey         string
-	UpdatedColumns map[string]string // Key is family:qualifier, val is value
+	RowKey         string            // Any bytes but empty, rows are ordered by byte-wise comparison
+	UpdatedColumns map[string][]byte // Key is family:qualifier of a declared family, val is value
+	Timestamp      int64             // Version of the cells in Unix nanoseconds, 0 for server time
+	TTL            time.Duration     // Lifetime of the cells counted from Timestamp, 0 for the family TTL only
 }
 
 type PutRowReply struct {
 	Status Status
 }
 
-type GetRowArgs struct {
+type DeleteRowArgs struct {
 	TableName string
 	RowKey    string
+	Timestamp int64 // Versions up to this one are deleted, 0 for server time
 }
 
-type GetRowReply struct {
+type DeleteRowReply struct {
+	Status Status
+}
+
+type DeleteColumnsArgs struct {
+	TableName           string
+	RowKey              string
+	QualifiedColumnKeys []string // Column family:qualifier
+	Timestamp           int64    // Versions up to this one are deleted, 0 for server time
+}
+
+type DeleteColumnsReply struct {
 	Status Status
-	Row    string
+}
+
+type DeleteFamilyArgs struct {
+	TableName string
+	RowKey    string
+	Family    string
+	Timestamp int64 // Versions up to this one are deleted, 0 for server time
+}
+
+type DeleteFamilyReply struct {
+	Status Status
+}
+
+type GetRowArgs struct {
+	TableName    string
+	RowKey       string
+	Columns      []string // Families and family:qualifier columns returned, nil for all
+	MaxVersions  int      // Versions returned per cell, 0 for the newest value only
+	MinTimestamp int64    // Oldest version returned, inclusive
+	MaxTimestamp int64    // Newest version returned, exclusive, 0 for no limit
+}
+
+// Cell is one version of a column in a reply. Only cells keep binary values:
+// the deprecated JSON fields of the replies hold values as JSON strings, in
+// which bytes that are not valid UTF-8 are replaced.
+type Cell struct {
+	Family    string
+	Qualifier string
+	Value     []byte
+	Timestamp int64 // Unix nanoseconds
+}
+
+type GetRowReply struct {
+	Status   Status
+	Cells    []Cell // Returned versions by family and qualifier, newest first
+	Row      string // Deprecated: newest value of every column as JSON, text values only, use Cells
+	Versions string // Deprecated: versions of every column as JSON, set when MaxVersions > 0, text values only, use Cells
 }
 
 type GetRowsArgs struct {
-	TableName   string
-	StartRowKey string
-	EndRowKey   string
+	TableName    string
+	StartRowKey  string
+	EndRowKey    string
+	Columns      []string // Families and family:qualifier columns read, nil for all
+	MaxVersions  int      // Versions returned per cell, 0 for the newest value only
+	MinTimestamp int64    // Oldest version returned, inclusive
+	MaxTimestamp int64    // Newest version returned, exclusive, 0 for no limit
+	Filter       *Filter  // Rows and columns returned out of the columns read, nil for all
 }
 
 type GetRowsReply struct {
+	Status   Status
+	Cells    map[string][]Cell // Row key -> returned versions of the row, as in GetRowReply
+	Rows     map[string]string // Deprecated: row key -> newest values as JSON, text values only, use Cells
+	Versions map[string]string // Deprecated: row key -> versions as JSON, set when MaxVersions > 0, text values only, use Cells
+}
+
+type ScanArgs struct {
+	TableName         string
+	StartRowKey       string   // First row key of the range, "" for the first row
+	EndRowKey         string   // Last row key of the range, inclusive, "" for the last row
+	Prefix            string   // Only rows whose key starts with it, "" for all
+	Reverse           bool     // Return the range from its end backwards
+	Limit             int      // Max rows per page, 0 for default (1000)
+	ByteLimit         int64    // Max bytes of keys and rows per page, 0 for default (4MB)
+	ContinuationToken string   // Token of the previous page, "" for the first page
+	Columns           []string // Families and family:qualifier columns read, nil for all
+	MaxVersions       int      // Versions returned per cell, 0 for the newest value only
+	MinTimestamp      int64    // Oldest version returned, inclusive
+	MaxTimestamp      int64    // Newest version returned, exclusive, 0 for no limit
+	Filter            *Filter  // Rows and columns returned out of the columns read, nil for all
+}
+
+// ScanRow is one row of a Scan page.
+type ScanRow struct {
+	RowKey   string
+	Cells    []Cell // Returned versions by family and qualifier, newest first
+	Row      string // Deprecated: column family:qualifier -> value as JSON, text values only, use Cells
+	Versions string // Deprecated: versions of the row as JSON, set when MaxVersions > 0, text values only, use Cells
+}
+
+type ScanReply struct {
+	Status            Status
+	Rows              []ScanRow // In key order, descending for Reverse
+	ContinuationToken string    // Token for the next page, "" when Done
+	Done              bool      // The end of the range was reached
+}
+
+type OpenScannerArgs struct {
+	TableName    string
+	StartRowKey  string        // First row key of the range, "" for the first row
+	EndRowKey    string        // Last row key of the range, inclusive, "" for the last row
+	Prefix       string        // Only rows whose key starts with it, "" for all
+	Reverse      bool          // Return the range from its end backwards
+	Columns      []string      // Families and family:qualifier columns read, nil for all
+	MaxVersions  int           // Versions returned per cell, 0 for the newest value only
+	MinTimestamp int64         // Oldest version returned, inclusive
+	MaxTimestamp int64         // Newest version returned, exclusive, 0 for no limit
+	Filter       *Filter       // Rows and columns returned out of the columns read, nil for all
+	Lease        time.Duration // Idle time after which the scanner is closed, 0 for default (1m)
+}
+
+type OpenScannerReply struct {
+	Status    Status
+	ScannerID uint64
+	Lease     time.Duration
+}
+
+type ScannerNextArgs struct {
+	ScannerID uint64
+	Limit     int   // Max rows of the page, 0 for default (1000)
+	ByteLimit int64 // Max bytes of keys and rows of the page, 0 for default (4MB)
+}
+
+type ScannerNextReply struct {
+	Status Status
+	Rows   []ScanRow // In key order, descending for Reverse
+	Done   bool      // The end of the range was reached and the scanner closed
+}
+
+type CloseScannerArgs struct {
+	ScannerID uint64
+}
+
+type CloseScannerReply struct {
 	Status Status
-	Rows   map[string]string
 }
 
 type GetColumnByRowArgs struct {
@@ -118,14 +367,84 @@ type GetColumnByRowArgs struct {
 
 type GetColumnByRowReply struct {
 	Status Status
-	Value  string
+	Value  []byte // Newest value, nil when the column is not set
 }
 
+// ConfigureTableArgs sets the options of a table, open or not. The other
+// nodes hosting the table are configured too. The reply is OK when any node
+// hosts the table.
+type ConfigureTableArgs struct {
+	TableName string
+	Options   TableOptions
+	Forwarded bool // Set on the calls between nodes, which are not passed on
+}
+
+type ConfigureTableReply struct {
+	TableHandle TableHandle // The table of this node, when it hosts it
+	Status      Status
+	Nodes       []NodeStatus // Replies of the other nodes, none when forwarded
+	FailedNodes []ServerNode // Nodes the change failed on, NodeUnavailable when any
+}
+
+// MemTableLimitArgs sets the memtable budget of a table on every node that
+// hosts it. Each node keeps its other options.
 type MemTableLimitArgs struct {
-	TableName    string
-	NewLimitRows int
+	TableName     string
+	NewLimitBytes int64 // Memtable budget in bytes
+	Forwarded     bool  // Set on the calls between nodes, which are not passed on
 }
 
 type MemTableLimitReply struct {
+	Status      Status
+	Nodes       []NodeStatus // Replies of the other nodes, none when forwarded
+	FailedNodes []ServerNode // Nodes the change failed on, NodeUnavailable when any
+}
+
+// CompactionProgress reports the background compaction of a table.
+type CompactionProgress struct {
+	Running       bool      // A compaction is in progress
+	Manual        bool      // The last compaction was requested by CompactTable
+	InputSegments int       // Segments merged by the last compaction
+	InputRows     int       // Rows stored in those segments
+	RowsWritten   int       // Merged rows written so far
+	Segments      int       // Segments of the table
+	Completed     int       // Compactions finished since the table was opened
+	LastFinished  time.Time // When the last compaction ended
+	LastError     string    // Error of the last compaction, empty on success
+}
+
+type CompactTableArgs struct {
+	TableName string
+}
+
+type CompactTableReply struct {
+	Status   Status
+	Progress CompactionProgress
+}
+
+type GetCompactionProgressArgs struct {
+	TableName string
+}
+
+type GetCompactionProgressReply struct {
+	Status   Status
+	Progress CompactionProgress
+}
+
+// CacheStats reports the block cache shared by the tables of a server.
+type CacheStats struct {
+	Capacity int64  // Budget in bytes
+	Size     int64  // Bytes cached
+	Entries  int    // Blocks cached
+	Hits     uint64 // Reads served from memory
+	Misses   uint64 // Reads that went to disk
+}
+
+type GetCacheStatsArgs struct {
+	// Intentionally left empty.
+}
+
+type GetCacheStatsReply struct {
 	Status Status
+	Stats  CacheStats
 }
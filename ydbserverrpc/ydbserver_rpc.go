@@ -7,11 +7,23 @@ type RemoteYDBServer interface {
 	OpenTable(*OpenTableArgs, *OpenTableReply) error
 	CloseTable(*CloseTableArgs, *CloseTableReply) error
 	DestroyTable(*DestroyTableArgs, *DestroyTableReply) error
+	AlterTable(*AlterTableArgs, *AlterTableReply) error
 	PutRow(*PutRowArgs, *PutRowReply) error
+	DeleteRow(*DeleteRowArgs, *DeleteRowReply) error
+	DeleteColumns(*DeleteColumnsArgs, *DeleteColumnsReply) error
+	DeleteFamily(*DeleteFamilyArgs, *DeleteFamilyReply) error
 	GetRow(*GetRowArgs, *GetRowReply) error
 	GetRows(*GetRowsArgs, *GetRowsReply) error
+	Scan(*ScanArgs, *ScanReply) error
+	OpenScanner(*OpenScannerArgs, *OpenScannerReply) error
+	ScannerNext(*ScannerNextArgs, *ScannerNextReply) error
+	CloseScanner(*CloseScannerArgs, *CloseScannerReply) error
 	GetColumnByRow(*GetColumnByRowArgs, *GetColumnByRowReply) error
+	ConfigureTable(*ConfigureTableArgs, *ConfigureTableReply) error
 	MemTableLimit(*MemTableLimitArgs, *MemTableLimitReply) error
+	CompactTable(*CompactTableArgs, *CompactTableReply) error
+	GetCompactionProgress(*GetCompactionProgressArgs, *GetCompactionProgressReply) error
+	GetCacheStats(*GetCacheStatsArgs, *GetCacheStatsReply) error
 }
 
 type YDBServer struct {